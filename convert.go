@@ -0,0 +1,468 @@
+package el
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// convertValue converts rightValue to a value which can be assigned to typ.
+//
+// Only lossless conversions are done:
+//
+//   - between int, uint and float kinds when the number fits the target
+//   - between bool/string kinds and their named types
+//   - string to time.Duration, and to any encoding.TextUnmarshaler (time.Time takes RFC3339)
+//   - json.Number to any numeric kind
+//   - generic decoded JSON (map[string]interface{}, []interface{}) to structs,
+//     maps, slices, arrays and pointers to them, item by item
+//   - nil to the zero value of typ
+//   - a value to a pointer to its copy, and a pointer to the value it points to
+//   - a value to an interface implemented by the pointer to its copy
+//   - a value to an optional wrapper (e.g. sql.NullString) holding it
+func convertValue(rightValue interface{}, typ reflect.Type) (reflect.Value, error) {
+	rv := reflect.ValueOf(rightValue)
+	if !rv.IsValid() {
+		return reflect.Zero(typ), nil
+	}
+	if rv.Type().AssignableTo(typ) {
+		return rv, nil
+	}
+
+	if typ.Kind() == reflect.Interface && reflect.PtrTo(rv.Type()).Implements(typ) {
+		pv := reflect.New(rv.Type())
+		pv.Elem().Set(rv)
+		return pv, nil
+	}
+	if rv.Kind() == reflect.Ptr && typ.Kind() != reflect.Ptr {
+		if rv.IsNil() {
+			return reflect.Zero(typ), nil
+		}
+		return convertValue(rv.Elem().Interface(), typ)
+	}
+	if adapter, ok := optionalAdapter(typ); ok && rv.Kind() != reflect.Map {
+		// An optional wrapper is set from the value it holds
+		ev, err := convertValue(rightValue, adapter.ValueType(typ))
+		if err != nil {
+			return rv, err
+		}
+		wv := reflect.New(typ).Elem()
+		adapter.Set(wv, ev)
+		return wv, nil
+	}
+
+	if nv, ok := rightValue.(json.Number); ok && typ.Kind() != reflect.Ptr {
+		n, err := (&Value{}).ToRealNumber(nv, typ)
+		if err != nil {
+			return rv, err
+		}
+		return reflect.ValueOf(n), nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Ptr:
+		if rv.Kind() != reflect.Ptr {
+			ev, err := convertValue(rightValue, typ.Elem())
+			if err != nil {
+				return rv, err
+			}
+			pv := reflect.New(typ.Elem())
+			pv.Elem().Set(ev)
+			return pv, nil
+		}
+	case reflect.Struct:
+		if rv.Kind() == reflect.Map && rv.Type().Key().Kind() == reflect.String {
+			return convertStruct(rv, typ)
+		}
+	case reflect.Map:
+		if rv.Kind() == reflect.Map {
+			return convertMap(rv, typ)
+		}
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+			return convertSlice(rv, typ)
+		}
+	}
+
+	if rv.Kind() == reflect.String {
+		if typ == durationType {
+			d, err := time.ParseDuration(rv.String())
+			if err != nil {
+				return rv, fmt.Errorf("Can not use value %q to patch %s type, err: %v", rv.String(), typ, err)
+			}
+			return reflect.ValueOf(d), nil
+		}
+		if reflect.PtrTo(typ).Implements(textUnmarshalerType) {
+			nv := reflect.New(typ)
+			if err := nv.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(rv.String())); err != nil {
+				return rv, fmt.Errorf("Can not use value %q to patch %s type, err: %v", rv.String(), typ, err)
+			}
+			return nv.Elem(), nil
+		}
+	}
+
+	nv := reflect.New(typ).Elem()
+	switch {
+	case rv.Kind() == reflect.String && typ.Kind() == reflect.String,
+		rv.Kind() == reflect.Bool && typ.Kind() == reflect.Bool:
+		return rv.Convert(typ), nil
+
+	case isIntKind(rv.Kind()):
+		n := rv.Int()
+		switch {
+		case isIntKind(typ.Kind()) && !nv.OverflowInt(n):
+			nv.SetInt(n)
+			return nv, nil
+		case isUintKind(typ.Kind()) && n >= 0 && !nv.OverflowUint(uint64(n)):
+			nv.SetUint(uint64(n))
+			return nv, nil
+		case isFloatKind(typ.Kind()) && setFloat(nv, float64(n)) && int64(nv.Float()) == n:
+			return nv, nil
+		}
+
+	case isUintKind(rv.Kind()):
+		n := rv.Uint()
+		switch {
+		case isIntKind(typ.Kind()) && n <= math.MaxInt64 && !nv.OverflowInt(int64(n)):
+			nv.SetInt(int64(n))
+			return nv, nil
+		case isUintKind(typ.Kind()) && !nv.OverflowUint(n):
+			nv.SetUint(n)
+			return nv, nil
+		case isFloatKind(typ.Kind()) && setFloat(nv, float64(n)) && uint64(nv.Float()) == n:
+			return nv, nil
+		}
+
+	case isFloatKind(rv.Kind()):
+		f := rv.Float()
+		isWhole := f == math.Trunc(f) && !math.IsInf(f, 0)
+		switch {
+		case isIntKind(typ.Kind()) && isWhole && f >= math.MinInt64 && f < math.MaxInt64 && !nv.OverflowInt(int64(f)):
+			nv.SetInt(int64(f))
+			return nv, nil
+		case isUintKind(typ.Kind()) && isWhole && f >= 0 && f < math.MaxUint64 && !nv.OverflowUint(uint64(f)):
+			nv.SetUint(uint64(f))
+			return nv, nil
+		case isFloatKind(typ.Kind()) && setFloat(nv, f):
+			return nv, nil
+		}
+	}
+
+	return rv, fmt.Errorf("Can not use value %v (%s) to patch %s type", rightValue, rv.Type(), typ)
+}
+
+// convertStruct fills a new typ struct from a map, keys are matched to
+// fields by name, json tag or case-insensitive name
+func convertStruct(rv reflect.Value, typ reflect.Type) (reflect.Value, error) {
+	nv := reflect.New(typ).Elem()
+	for _, key := range rv.MapKeys() {
+		name := key.String()
+		field, err := lookupField(typ, name)
+		if err != nil {
+			return rv, err
+		}
+		fv, err := convertValue(rv.MapIndex(key).Interface(), field.Type)
+		if err != nil {
+			return rv, fmt.Errorf("Field %s: %v", name, err)
+		}
+		target, err := fieldByIndex(nv, field.Index, &evalContext{write: true})
+		if err != nil {
+			return rv, err
+		}
+		target.Set(fv)
+	}
+	return nv, nil
+}
+
+func convertMap(rv reflect.Value, typ reflect.Type) (reflect.Value, error) {
+	nv := reflect.MakeMapWithSize(typ, rv.Len())
+	for _, key := range rv.MapKeys() {
+		kv, err := convertValue(key.Interface(), typ.Key())
+		if err != nil {
+			return rv, err
+		}
+		ev, err := convertValue(rv.MapIndex(key).Interface(), typ.Elem())
+		if err != nil {
+			return rv, fmt.Errorf("Key %v: %v", key.Interface(), err)
+		}
+		nv.SetMapIndex(kv, ev)
+	}
+	return nv, nil
+}
+
+func convertSlice(rv reflect.Value, typ reflect.Type) (reflect.Value, error) {
+	var nv reflect.Value
+	if typ.Kind() == reflect.Array {
+		if rv.Len() > typ.Len() {
+			return rv, fmt.Errorf("Can not use %d items to patch %s type", rv.Len(), typ)
+		}
+		nv = reflect.New(typ).Elem()
+	} else {
+		nv = reflect.MakeSlice(typ, rv.Len(), rv.Len())
+	}
+	for i := 0; i < rv.Len(); i++ {
+		ev, err := convertValue(rv.Index(i).Interface(), typ.Elem())
+		if err != nil {
+			return rv, fmt.Errorf("Index %d: %v", i, err)
+		}
+		nv.Index(i).Set(ev)
+	}
+	return nv, nil
+}
+
+// lookupField finds exported field of struct typ by its Go name, then its
+// json tag name, then its name ignoring case. Fields promoted from embedded
+// structs are found like Go does, the shallowest one wins and more than one
+// at the same depth is an error
+func lookupField(typ reflect.Type, name string) (reflect.StructField, error) {
+	for _, match := range fieldMatchers(name) {
+		fields := searchField(typ, match)
+		switch {
+		case len(fields) == 1:
+			return fields[0], nil
+		case len(fields) > 1:
+			return fields[0], ambiguousField(typ, name, fields)
+		}
+	}
+	return reflect.StructField{}, fmt.Errorf("Can't find field '%s' in type %s", name, typ)
+}
+
+// fieldMatchers match a field by its Go name, then its json tag name, then
+// its name ignoring case
+func fieldMatchers(name string) []func(f reflect.StructField) bool {
+	return []func(f reflect.StructField) bool{
+		func(f reflect.StructField) bool { return f.Name == name },
+		func(f reflect.StructField) bool { return strings.Split(f.Tag.Get("json"), ",")[0] == name },
+		func(f reflect.StructField) bool { return strings.EqualFold(f.Name, name) },
+	}
+}
+
+// hasField reports whether typ, or the struct it points to, has a field
+// found by lookupField, even an ambiguous one
+func hasField(typ reflect.Type, name string) bool {
+	typ = indirectType(typ)
+	if typ.Kind() != reflect.Struct {
+		return false
+	}
+	for _, match := range fieldMatchers(name) {
+		if len(searchField(typ, match)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ambiguousField explains why name matches all fields of typ: they differ
+// only in case, or the same name is promoted from more than one embedded struct
+func ambiguousField(typ reflect.Type, name string, fields []reflect.StructField) error {
+	paths := make([]string, 0, len(fields))
+	names := map[string]bool{}
+	for _, f := range fields {
+		paths = append(paths, fmt.Sprintf("'%s'", fieldPath(typ, f.Index)))
+		names[f.Name] = true
+	}
+	if len(names) == len(fields) {
+		return fmt.Errorf("Field '%s' is ambiguous in type %s, it matches %s ignoring case, use the exact name",
+			name, typ, strings.Join(paths, " and "))
+	}
+	return fmt.Errorf("Field '%s' is ambiguous in type %s, name its embedded struct: %s",
+		name, typ, strings.Join(paths, " or "))
+}
+
+// fieldPath names the field at index of typ through its embedded structs,
+// e.g. `Base.ID`
+func fieldPath(typ reflect.Type, index []int) string {
+	names := make([]string, 0, len(index))
+	for _, i := range index {
+		typ = indirectType(typ)
+		f := typ.Field(i)
+		names = append(names, f.Name)
+		typ = f.Type
+	}
+	return strings.Join(names, ".")
+}
+
+// searchField returns exported fields matched at the shallowest depth of
+// typ and its embedded structs, with Index leading to them from typ
+func searchField(typ reflect.Type, match func(f reflect.StructField) bool) []reflect.StructField {
+	type embedded struct {
+		typ   reflect.Type
+		index []int
+	}
+	current := []embedded{{typ: typ}}
+	visited := map[reflect.Type]bool{}
+	for len(current) > 0 {
+		var next []embedded
+		var found []reflect.StructField
+		for _, e := range current {
+			if visited[e.typ] {
+				continue
+			}
+			for i := 0; i < e.typ.NumField(); i++ {
+				f := e.typ.Field(i)
+				index := append(append([]int{}, e.index...), i)
+				if f.PkgPath == "" && match(f) {
+					f.Index = index
+					found = append(found, f)
+					continue
+				}
+				if ft := indirectType(f.Type); f.Anonymous && ft.Kind() == reflect.Struct {
+					next = append(next, embedded{typ: ft, index: index})
+				}
+			}
+		}
+		if len(found) > 0 {
+			return found
+		}
+		for _, e := range current {
+			visited[e.typ] = true
+		}
+		current = next
+	}
+	return nil
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex but handles nil embedded
+// pointers with allocEmbedded, the field is nil (invalid) for reading then
+func fieldByIndex(v reflect.Value, index []int, ctx *evalContext) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			var err error
+			if v, err = allocEmbedded(v, ctx); !v.IsValid() {
+				return v, err
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// allocEmbedded returns embedded pointer v, when it's nil it's allocated for
+// writing, a detached one is used for dry run, and nil (invalid) for reading
+func allocEmbedded(v reflect.Value, ctx *evalContext) (reflect.Value, error) {
+	if !v.IsNil() {
+		return v, nil
+	}
+	switch {
+	case ctx.dryRun:
+		return reflect.New(v.Type().Elem()), nil
+	case ctx.write:
+		if !v.CanSet() {
+			return reflect.Value{}, fmt.Errorf("Embedded %s is nil and can't be allocated", v.Type())
+		}
+		v.Set(reflect.New(v.Type().Elem()))
+		return v, nil
+	}
+	return reflect.Value{}, nil
+}
+
+func isIntKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func isUintKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+func isFloatKind(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+// setFloat sets f into float nv, reporting whether nv's type holds f
+// within its precision, see fitsFloat32
+func setFloat(nv reflect.Value, f float64) bool {
+	if nv.OverflowFloat(f) {
+		return false
+	}
+	nv.SetFloat(f)
+	return nv.Kind() != reflect.Float32 || fitsFloat32(f)
+}
+
+// fitsFloat32 reports whether f is held by float32 within its precision:
+// the float32 nearest to f, written as its shortest decimal, reads back as
+// f. So 0.1 fits, like json.Number("0.1") does, but 16777217 doesn't
+func fitsFloat32(f float64) bool {
+	s := strconv.FormatFloat(float64(float32(f)), 'g', -1, 32)
+	back, _ := strconv.ParseFloat(s, 64)
+	return back == f || math.IsNaN(f)
+}
+
+// copyValue returns a deep copy of v, so slices, maps and pointers of the
+// copy aren't shared with v. Unexported fields are copied as they are,
+// seen keeps copies of pointers already copied, for cyclic data
+func copyValue(v reflect.Value, seen map[uintptr]reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		if c, ok := seen[v.Pointer()]; ok {
+			return c
+		}
+		c := reflect.New(v.Type().Elem())
+		seen[v.Pointer()] = c
+		c.Elem().Set(copyValue(v.Elem(), seen))
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(copyValue(v.Elem(), seen))
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i), seen))
+		}
+		return c
+	case reflect.Array:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i), seen))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), copyValue(iter.Value(), seen))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(copyValue(v.Field(i), seen))
+			}
+		}
+		return c
+	}
+	return v
+}
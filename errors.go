@@ -1,6 +1,10 @@
 package el
 
-import "fmt"
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
 
 type Error struct {
 	Expression string
@@ -8,6 +12,7 @@ type Error struct {
 	Column     int
 	Token      *Token
 	ErrorMsg   string
+	Err        error // underlying error if any, e.g. *MethodDeniedError
 }
 
 // Returns a nice formatted error string.
@@ -24,6 +29,11 @@ func (e *Error) Error() string {
 	return s
 }
 
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
 func NewError(msg string, token *Token) *Error {
 	var line, col int
 	if token != nil {
@@ -39,3 +49,89 @@ func NewError(msg string, token *Token) *Error {
 		ErrorMsg: msg,
 	}
 }
+
+// wrapError converts err into *Error located at token, an *Error is kept as is
+func wrapError(err error, token *Token) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	e := NewError(err.Error(), token)
+	e.Err = err
+	return e
+}
+
+// recoveredError converts a value recovered from panic into *Error located at token
+func recoveredError(r interface{}, token *Token) *Error {
+	e := NewError(fmt.Sprintf("Recovered from panic: %v", r), token)
+	if err, ok := r.(error); ok {
+		e.Err = err
+	}
+	return e
+}
+
+// MethodDeniedError is reported when an expression calls a method which
+// is not allowed by MethodPolicy
+type MethodDeniedError struct {
+	Type   reflect.Type
+	Method string
+}
+
+func (e *MethodDeniedError) Error() string {
+	return fmt.Sprintf("Method %s of %s is not allowed to be called", e.Method, e.Type)
+}
+
+// LimitError is reported when an expression or patch exceeds a limit of EvalOptions
+type LimitError struct {
+	Limit  string
+	Max    int
+	Actual int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s exceeds the limit %d (got %d)", e.Limit, e.Max, e.Actual)
+}
+
+// EntryError is the error of one patch entry
+type EntryError struct {
+	Path Expression
+	Err  error
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("path: %s %v", e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// PreconditionError is reported when a precondition of a patch doesn't hold,
+// nothing of the patch is applied then
+type PreconditionError struct {
+	Condition Expression
+	Err       error // error evaluating the condition if any
+}
+
+func (e *PreconditionError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("precondition %s failed: %v", e.Condition, e.Err)
+	}
+	return fmt.Sprintf("precondition %s failed", e.Condition)
+}
+
+// Unwrap returns the underlying error
+func (e *PreconditionError) Unwrap() error {
+	return e.Err
+}
+
+// PatchErrors collects errors of all patch entries
+type PatchErrors []error
+
+func (e PatchErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
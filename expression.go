@@ -5,7 +5,47 @@ import "strings"
 // Expression to Patch
 type Expression string
 
+// Execute evaluates a trusted expression against target, every method can be
+// called and limits take their defaults
 func (path *Expression) Execute(target interface{}) (*Value, error) {
+	return path.ExecuteWith(target, nil)
+}
+
+// ExecuteWith evaluates expression against target under opts, nil opts
+// is the same as Execute.
+//
+// Evaluation only reads target: a slice index past the end gives nil, and
+// the slice only grows when the value is set by SetValue
+func (path *Expression) ExecuteWith(target interface{}, opts *EvalOptions) (*Value, error) {
+	return path.executeIn(newEvalContext(target, opts))
+}
+
+// ExecuteForWrite evaluates expression against target under opts for
+// writing the result. Unlike ExecuteWith, which never changes target, slices
+// are grown for items navigated past their end, e.g. `Images[5].Content`
+func (path *Expression) ExecuteForWrite(target interface{}, opts *EvalOptions) (*Value, error) {
+	ctx := newEvalContext(target, opts)
+	ctx.write = true
+	return path.executeIn(ctx)
+}
+
+func (path *Expression) executeIn(ctx *evalContext) (value *Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			value, err = nil, recoveredError(r, nil)
+		}
+		if e, ok := err.(*Error); ok {
+			e.Expression = string(*path)
+		}
+	}()
+	return path.execute(ctx)
+}
+
+func (path *Expression) execute(ctx *evalContext) (*Value, error) {
+
+	if err := checkLimit("expression length", len(*path), ctx.opts.MaxExpressionLength, DefaultMaxExpressionLength); err != nil {
+		return nil, err
+	}
 
 	toks, err := Lex(string(*path))
 	if err != nil {
@@ -13,13 +53,14 @@ func (path *Expression) Execute(target interface{}) (*Value, error) {
 	}
 
 	parser := NewParser(toks)
+	parser.maxDepth = ctx.opts.MaxDepth
 
 	exp, err := parser.ParseExp()
 	if err != nil {
 		return nil, err
 	}
 
-	value, err := exp.Evaluate(target)
+	value, err := exp.evaluate(ctx)
 
 	if err != nil {
 		return nil, err
@@ -29,10 +70,12 @@ func (path *Expression) Execute(target interface{}) (*Value, error) {
 
 }
 
+// FirstPart returns the segment before the first dot as written, e.g.
+// `roleState` for `roleState.admin`, or "" when there is no dot
 func (p Expression) FirstPart() string {
 	idx := strings.Index(string(p), ".")
 	if idx == -1 {
 		return ""
 	}
-	return upperFirst(string(p)[:idx])
+	return string(p)[:idx]
 }
@@ -2,10 +2,14 @@ package el_test
 
 import (
 	"testing"
+	"time"
 
 	"encoding/json"
+	"fmt"
 	"github.com/lysu/go-el"
 	"github.com/stretchr/testify/assert"
+	"math/big"
+	"reflect"
 	"strconv"
 )
 
@@ -15,6 +19,7 @@ type User struct {
 	ImgIDList []int
 	Images    []*Image
 	ImgIdx    map[string]*Image
+	Avatar    *Image
 }
 
 type Image struct {
@@ -164,3 +169,518 @@ func TestIndexSet(t *testing.T) {
 	v.SetValue(99)
 	assert.Equal(t, 99, user.ImgIDList[99])
 }
+
+func TestSafeNavigation(t *testing.T) {
+	user := User{
+		Name:   "ほん",
+		ImgIdx: map[string]*Image{},
+	}
+
+	exp := el.Expression("Avatar.Content")
+	_, err := exp.Execute(&user)
+	assert.Error(t, err)
+
+	exp = el.Expression("Avatar?.Content")
+	v, err := exp.Execute(&user)
+	assert.NoError(t, err)
+	assert.True(t, v.IsNil())
+
+	exp = el.Expression("ImgIdx[0].Content")
+	_, err = exp.Execute(&user)
+	assert.Error(t, err)
+
+	exp = el.Expression("ImgIdx[0]?.Content")
+	v, err = exp.Execute(&user)
+	assert.NoError(t, err)
+	assert.True(t, v.IsNil())
+
+	exp = el.Expression("Avatar?[0]")
+	v, err = exp.Execute(&user)
+	assert.NoError(t, err)
+	assert.True(t, v.IsNil())
+
+	user.Avatar = &Image{"a.jpg"}
+	exp = el.Expression("Avatar?.Content")
+	v, err = exp.Execute(&user)
+	assert.NoError(t, err)
+	assert.Equal(t, "a.jpg", v.String())
+}
+
+func TestCoalesceAndConditional(t *testing.T) {
+	user := User{
+		Name:      "ほん",
+		ImgIDList: []int{0, 1, 2},
+	}
+
+	exp := el.Expression(`Avatar?.Content ?? "none.jpg"`)
+	v, err := exp.Execute(&user)
+	assert.NoError(t, err)
+	assert.Equal(t, "none.jpg", v.String())
+
+	exp = el.Expression(`Name ?? "anonymous"`)
+	v, err = exp.Execute(&user)
+	assert.NoError(t, err)
+	assert.Equal(t, "ほん", v.String())
+
+	// the branch not taken is never resolved
+	exp = el.Expression(`ImgIDList ? Name : Avatar.Content`)
+	v, err = exp.Execute(&user)
+	assert.NoError(t, err)
+	assert.Equal(t, "ほん", v.String())
+
+	exp = el.Expression(`false ? Avatar.Content : (BizState ? "set" : "unset")`)
+	v, err = exp.Execute(&user)
+	assert.NoError(t, err)
+	assert.Equal(t, "unset", v.String())
+
+	exp = el.Expression(`true ? Name`)
+	_, err = exp.Execute(&user)
+	assert.Error(t, err)
+}
+
+func TestCompare(t *testing.T) {
+	user := User{
+		Name:      "ほん",
+		ImgIDList: []int{0, 1, 2},
+	}
+
+	for exp, expected := range map[el.Expression]bool{
+		`Name == "ほん"`:                 true,
+		`Name != "ほん"`:                 false,
+		`ImgIDList[2] == 2`:            true,
+		`ImgIDList[1] != 2`:            true,
+		`Avatar?.Content == "x"`:       false,
+		`(Avatar ?? 1) == 1`:           true,
+		`ImgIDList[0] == 0 ? true : 1`: true,
+	} {
+		v, err := exp.Execute(&user)
+		assert.NoError(t, err, exp)
+		assert.Equal(t, expected, v.IsTrue(), exp)
+	}
+
+	// json.Number integers compare exactly, past 2^53 too, others as floats
+	data := map[string]interface{}{
+		"id":    json.Number("9007199254740992"),
+		"big":   json.Number("18446744073709551616"),
+		"ratio": json.Number("0.5"),
+		"half":  0.5,
+		"float": 9007199254740992.0,
+		"max":   uint64(18446744073709551615),
+	}
+	for exp, expected := range map[el.Expression]bool{
+		`id == 9007199254740992`: true,
+		`id == 9007199254740993`: false,
+		`id != 9007199254740993`: true,
+		`id == float`:            true,
+		`big == max`:             false,
+		`ratio == half`:          true,
+	} {
+		v, err := exp.Execute(data)
+		assert.NoError(t, err, exp)
+		assert.Equal(t, expected, v.IsTrue(), exp)
+	}
+
+	exp := el.Expression(`Name == `)
+	_, err := exp.Execute(&user)
+	assert.Error(t, err)
+}
+
+type Status string
+
+type Level int
+
+func (l *Level) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "low":
+		*l = 1
+	case "high":
+		*l = 2
+	default:
+		return fmt.Errorf("unknown level %q", text)
+	}
+	return nil
+}
+
+type Task struct {
+	ID       int64
+	Retry    uint8
+	Weight   float32
+	Status   Status
+	Level    Level
+	Deadline time.Time
+	Timeout  time.Duration
+	Scores   map[string]int
+}
+
+func TestSetValueConversion(t *testing.T) {
+	task := Task{Scores: map[string]int{}}
+
+	cases := []struct {
+		exp   string
+		value interface{}
+	}{
+		{"ID", 42},
+		{"Retry", float64(3)},
+		{"Weight", 1.5},
+		{"Status", "done"},
+		{"Level", "high"},
+		{"Deadline", "2016-01-02T15:04:05Z"},
+		{"Timeout", "1m30s"},
+		{`Scores["a"]`, float64(7)},
+	}
+	for _, c := range cases {
+		exp := el.Expression(c.exp)
+		v, err := exp.Execute(&task)
+		assert.NoError(t, err, c.exp)
+		assert.NoError(t, v.SetValue(c.value), c.exp)
+	}
+	assert.Equal(t, int64(42), task.ID)
+	assert.Equal(t, uint8(3), task.Retry)
+	assert.Equal(t, float32(1.5), task.Weight)
+	assert.Equal(t, Status("done"), task.Status)
+	assert.Equal(t, Level(2), task.Level)
+	assert.Equal(t, time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC), task.Deadline)
+	assert.Equal(t, 90*time.Second, task.Timeout)
+	assert.Equal(t, 7, task.Scores["a"])
+
+	lossy := []struct {
+		exp   string
+		value interface{}
+	}{
+		{"Retry", 256},
+		{"Retry", -1},
+		{"ID", 1.5},
+		{"Level", "medium"},
+		{"Deadline", "yesterday"},
+		{"Status", 1},
+		{"Weight", 0.10000000000000002},
+		{"Weight", 16777217},
+		{"Weight", uint64(16777217)},
+		{"Weight", json.Number("16777217")},
+		{"Weight", json.Number("0.10000000000000002")},
+	}
+	for _, c := range lossy {
+		exp := el.Expression(c.exp)
+		v, err := exp.Execute(&task)
+		assert.NoError(t, err, c.exp)
+		assert.Error(t, v.SetValue(c.value), c.exp)
+	}
+	assert.Equal(t, uint8(3), task.Retry)
+	assert.Equal(t, float32(1.5), task.Weight)
+
+	// Decimals are held by float32 within its precision, however decoded
+	exp := el.Expression("Weight")
+	for _, value := range []interface{}{0.1, json.Number("0.1")} {
+		v, err := exp.Execute(&task)
+		assert.NoError(t, err)
+		assert.NoError(t, v.SetValue(value))
+		assert.Equal(t, float32(0.1), task.Weight)
+	}
+}
+
+type Meter float32
+
+type Measure struct {
+	Length Meter
+	Ratio  float32
+	Total  uint64
+	Count  int8
+	Huge   *big.Int
+}
+
+func TestToRealNumber(t *testing.T) {
+	var v el.Value
+
+	n, err := v.ToRealNumber(json.Number("1.5"), reflect.TypeOf(float32(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, float32(1.5), n)
+
+	n, err = v.ToRealNumber(json.Number("2.5"), reflect.TypeOf(Meter(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, Meter(2.5), n)
+
+	n, err = v.ToRealNumber(json.Number("1e3"), reflect.TypeOf(int16(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, int16(1000), n)
+
+	n, err = v.ToRealNumber(json.Number("18446744073709551615"), reflect.TypeOf(uint64(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(18446744073709551615), n)
+
+	for _, c := range []struct {
+		nv  string
+		typ reflect.Type
+	}{
+		{"1e40", reflect.TypeOf(float32(0))},
+		{"128", reflect.TypeOf(int8(0))},
+		{"-1", reflect.TypeOf(uint(0))},
+		{"1.5", reflect.TypeOf(0)},
+		{"1e99999999", reflect.TypeOf(0)},
+		{"abc", reflect.TypeOf(0)},
+		{"1", reflect.TypeOf("")},
+	} {
+		_, err = v.ToRealNumber(json.Number(c.nv), c.typ)
+		assert.Error(t, err, c.nv)
+	}
+
+	m := Measure{Huge: new(big.Int)}
+	patcher := el.Patcher{}
+	err = patcher.PatchIt(&m, el.Patch{
+		"Length": json.Number("3.25"),
+		"Ratio":  json.Number("0.5"),
+		"Total":  json.Number("12345678901234567890"),
+		"Huge":   json.Number("123456789012345678901234567890"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, Meter(3.25), m.Length)
+	assert.Equal(t, float32(0.5), m.Ratio)
+	assert.Equal(t, uint64(12345678901234567890), m.Total)
+	assert.Equal(t, "123456789012345678901234567890", m.Huge.String())
+
+	err = patcher.PatchIt(&m, el.Patch{"Count": json.Number("300")})
+	assert.Error(t, err)
+}
+
+type Registry struct {
+	Names map[int]string
+	Tags  map[string]int
+	IDs   []int
+}
+
+func (r Registry) Broken() string {
+	panic("broken method")
+}
+
+func TestPanicSafe(t *testing.T) {
+	r := Registry{IDs: []int{1}}
+
+	exp := el.Expression("IDs.0 ?? Broken()")
+	_, err := exp.Execute(&r)
+	assert.NoError(t, err)
+
+	exp = el.Expression("Tags.x ?? Broken()")
+	_, err = exp.Execute(&r)
+	if assert.Error(t, err) {
+		e, ok := err.(*el.Error)
+		assert.True(t, ok)
+		assert.Equal(t, 11, e.Column)
+		assert.Equal(t, "Tags.x ?? Broken()", e.Expression)
+	}
+
+	exp = el.Expression(`Names["x"]`)
+	_, err = exp.Execute(&r)
+	assert.Error(t, err)
+
+	exp = el.Expression(`IDs[-1]`)
+	_, err = exp.Execute(&r)
+	assert.Error(t, err)
+
+	// slice of unaddressable struct can't grow
+	exp = el.Expression(`IDs[5]`)
+	v, err := exp.Execute(r)
+	assert.NoError(t, err)
+	assert.Error(t, v.SetValue(5))
+
+	// nil map is created on write
+	exp = el.Expression(`Tags["a"]`)
+	v, err = exp.Execute(&r)
+	assert.NoError(t, err)
+	assert.NoError(t, v.SetValue(1))
+	assert.Equal(t, 1, r.Tags["a"])
+
+	exp = el.Expression(`Names[1]`)
+	v, err = exp.Execute(&r)
+	assert.NoError(t, err)
+	assert.NoError(t, v.SetValue("one"))
+	assert.Equal(t, "one", r.Names[1])
+}
+
+type Album struct {
+	Images []Image
+	Tags   []string
+}
+
+func TestReadDoesNotMutate(t *testing.T) {
+	album := Album{Tags: []string{"a"}}
+
+	exp := el.Expression("Tags[99]")
+	v, err := exp.Execute(&album)
+	assert.NoError(t, err)
+	assert.True(t, v.IsNil())
+	assert.Len(t, album.Tags, 1)
+
+	exp = el.Expression("Images[2]?.Content")
+	v, err = exp.Execute(&album)
+	assert.NoError(t, err)
+	assert.True(t, v.IsNil())
+	assert.Len(t, album.Images, 0)
+
+	exp = el.Expression("Images[2].Content")
+	_, err = exp.Execute(&album)
+	assert.Error(t, err)
+
+	// A failed write doesn't grow the slice
+	exp = el.Expression("Tags[2]")
+	v, err = exp.Execute(&album)
+	assert.NoError(t, err)
+	assert.Error(t, v.SetValue(1))
+	assert.Len(t, album.Tags, 1)
+	assert.NoError(t, v.SetValue("c"))
+	assert.Equal(t, []string{"a", "", "c"}, album.Tags)
+
+	v, err = exp.ExecuteForWrite(&album, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "c", v.String())
+
+	exp = el.Expression("Images[1].Content")
+	v, err = exp.ExecuteForWrite(&album, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, v.SetValue("2.jpg"))
+	assert.Equal(t, []Image{{}, {"2.jpg"}}, album.Images)
+}
+
+func TestUnicodeAndQuotedPath(t *testing.T) {
+	user := User{
+		BizState: map[string]int{"状態": 1, "my.key": 2, "a-b": 3},
+	}
+
+	for exp, expected := range map[el.Expression]int{
+		`BizState.状態`:        1,
+		`BizState."状態"`:      1,
+		`BizState."my.key"`:  2,
+		`BizState["my.key"]`: 2,
+		`BizState?."a-b"`:    3,
+	} {
+		v, err := exp.Execute(&user)
+		assert.NoError(t, err, exp)
+		assert.Equal(t, expected, v.Interface(), exp)
+	}
+
+	exp := el.Expression(`BizState."x.y"`)
+	v, err := exp.Execute(&user)
+	assert.NoError(t, err)
+	assert.True(t, v.IsNil())
+	assert.NoError(t, v.SetValue(4))
+	assert.Equal(t, 4, user.BizState["x.y"])
+	assert.Equal(t, `BizState["x.y"]`, v.Path())
+
+	// Columns count characters
+	exp = el.Expression(`BizState.状態 ^`)
+	_, err = exp.Execute(&user)
+	if assert.Error(t, err) {
+		assert.Equal(t, 13, err.(*el.Error).Column)
+	}
+	exp = el.Expression(`BizState."状態".x`)
+	_, err = exp.Execute(&user)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `BizState."状態".x`)
+	}
+}
+
+type Counter struct {
+	N int
+}
+
+func (c *Counter) Incr() int {
+	c.N++
+	return c.N
+}
+
+type Counters struct {
+	Main   Counter
+	ByName map[string]Counter
+}
+
+func (c Counters) Snapshot() Counter {
+	return c.Main
+}
+
+func TestPointerReceiverMethods(t *testing.T) {
+	c := &Counters{ByName: map[string]Counter{"a": {N: 5}}}
+
+	// Fields reached through a pointer are addressable
+	exp := el.Expression("Main.Incr()")
+	v, err := exp.Execute(c)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v.Interface())
+	assert.Equal(t, 1, c.Main.N)
+
+	// Map items aren't, unless receivers are copied back
+	exp = el.Expression(`ByName["a"].Incr()`)
+	_, err = exp.Execute(c)
+	assert.Error(t, err)
+	assert.Equal(t, 5, c.ByName["a"].N)
+
+	opts := &el.EvalOptions{Methods: el.AllowAllMethods(), CopyBackReceivers: true}
+	v, err = exp.ExecuteWith(c, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, v.Interface())
+	assert.Equal(t, 6, c.ByName["a"].N)
+
+	// A result of a call is copied, there's nothing to store it back to
+	exp = el.Expression("Snapshot().Incr()")
+	v, err = exp.ExecuteWith(c, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v.Interface())
+	assert.Equal(t, 1, c.Main.N)
+}
+
+type Named interface {
+	Name() string
+}
+
+type Tag struct {
+	Label string
+}
+
+func (t *Tag) Name() string {
+	return t.Label
+}
+
+type Post struct {
+	Avatar *Image
+	Cover  Image
+	Count  int
+	Extra  interface{}
+	Owner  Named
+	Tags   map[string]*Tag
+}
+
+func TestSetValuePointerInterfaceNil(t *testing.T) {
+	post := &Post{Avatar: &Image{Content: "a"}, Count: 3, Extra: []interface{}{1}}
+	set := func(exp el.Expression, value interface{}) error {
+		v, err := exp.Execute(post)
+		if err != nil {
+			return err
+		}
+		return v.SetValue(value)
+	}
+
+	// nil zeroes
+	assert.NoError(t, set("Avatar", nil))
+	assert.Nil(t, post.Avatar)
+	assert.NoError(t, set("Count", nil))
+	assert.Equal(t, 0, post.Count)
+
+	// A value is copied for a pointer, a pointer is dereferenced for a value
+	img := Image{Content: "b"}
+	assert.NoError(t, set("Avatar", img))
+	assert.Equal(t, &img, post.Avatar)
+	img.Content = "changed"
+	assert.Equal(t, "b", post.Avatar.Content)
+	assert.NoError(t, set("Cover", &Image{Content: "c"}))
+	assert.Equal(t, Image{Content: "c"}, post.Cover)
+	assert.NoError(t, set(`Tags["x"]`, Tag{Label: "x"}))
+	assert.Equal(t, "x", post.Tags["x"].Label)
+
+	// Interfaces take what implements them, also by a pointer to a copy
+	assert.NoError(t, set("Owner", Tag{Label: "o"}))
+	assert.Equal(t, "o", post.Owner.Name())
+	assert.Error(t, set("Owner", 1))
+	assert.NoError(t, set("Extra", "s"))
+	assert.Equal(t, "s", post.Extra)
+	assert.NoError(t, set("Extra", nil))
+	assert.Nil(t, post.Extra)
+	assert.NoError(t, set("Extra", 2))
+	assert.Equal(t, 2, post.Extra)
+}
@@ -19,12 +19,11 @@ const (
 )
 
 var (
-	tokenSpaceChars                = " \n\r\t"
-	tokenIdentifierChars           = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_"
-	tokenIdentifierCharsWithDigits = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_0123456789"
-	tokenDigits                    = "0123456789"
+	tokenSpaceChars = " \n\r\t"
+	tokenDigits     = "0123456789"
 
-	TokenSymbols = []string{";", "(", ")", ".", "[", "]"}
+	// TokenSymbols is matched in order, so longer symbols must come before their prefixes
+	TokenSymbols = []string{"==", "!=", "??", "?.", "?[", "?", ":", ";", "(", ")", ".", "[", "]", "+", "-"}
 
 	TokenKeywords = []string{"true", "false"}
 )
@@ -82,17 +81,9 @@ func (l *lexer) length() int {
 }
 
 func (l *lexer) emit(t TokenType) {
-	l.emitWithChange(t, nil)
-}
-
-func (l *lexer) emitWithChange(t TokenType, changeToken func(string) string) {
-	value := l.value()
-	if changeToken != nil {
-		value = changeToken(value)
-	}
 	tok := &Token{
 		Typ:  t,
-		Val:  value,
+		Val:  l.value(),
 		Line: l.startline,
 		Col:  l.startcol,
 	}
@@ -108,14 +99,6 @@ func (l *lexer) emitWithChange(t TokenType, changeToken func(string) string) {
 	l.startcol = l.col
 }
 
-func upperFirst(s string) string {
-	if s == "" {
-		return ""
-	}
-	r, n := utf8.DecodeRuneInString(s)
-	return string(unicode.ToUpper(r)) + s[n:]
-}
-
 func (l *lexer) next() rune {
 	if l.pos >= len(l.input) {
 		l.width = 0
@@ -124,13 +107,16 @@ func (l *lexer) next() rune {
 	r, w := utf8.DecodeRuneInString(l.input[l.pos:])
 	l.width = w
 	l.pos += l.width
-	l.col += l.width
+	// Columns count characters, not bytes
+	l.col++
 	return r
 }
 
 func (l *lexer) backup() {
 	l.pos -= l.width
-	l.col -= l.width
+	if l.width > 0 {
+		l.col--
+	}
 }
 
 func (l *lexer) peek() rune {
@@ -159,6 +145,30 @@ func (l *lexer) acceptRun(what string) {
 	l.backup()
 }
 
+func (l *lexer) acceptFunc(valid func(rune) bool) bool {
+	if valid(l.next()) {
+		return true
+	}
+	l.backup()
+	return false
+}
+
+func (l *lexer) acceptRunFunc(valid func(rune) bool) {
+	for valid(l.next()) {
+	}
+	l.backup()
+}
+
+// isIdentifierStart reports whether r can start an identifier, like in Go
+// any unicode letter can
+func isIdentifierStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentifierChar(r rune) bool {
+	return isIdentifierStart(r) || unicode.IsDigit(r)
+}
+
 func (l *lexer) errorf(format string, args ...interface{}) lexerStateFn {
 	t := &Token{
 		Typ:  TokenError,
@@ -201,7 +211,7 @@ outer_loop:
 			}
 			l.ignore()
 			continue
-		case l.accept(tokenIdentifierChars):
+		case l.acceptFunc(isIdentifierStart):
 			return l.stateIdentifier
 		case l.accept(tokenDigits):
 			return l.stateNumber
@@ -239,15 +249,14 @@ func (l *lexer) stateNumber() lexerStateFn {
 }
 
 func (l *lexer) stateIdentifier() lexerStateFn {
-	l.acceptRun(tokenIdentifierChars)
-	l.acceptRun(tokenIdentifierCharsWithDigits)
+	l.acceptRunFunc(isIdentifierChar)
 	for _, kw := range TokenKeywords {
 		if kw == l.value() {
 			l.emit(TokenKeyword)
 			return l.stateCode
 		}
 	}
-	l.emitWithChange(TokenIdentifier, upperFirst)
+	l.emit(TokenIdentifier)
 	return l.stateCode
 }
 
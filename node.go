@@ -1,7 +1,9 @@
 package el
 
 import (
+	"encoding/json"
 	"fmt"
+	"math/big"
 	"reflect"
 	"strconv"
 	"strings"
@@ -10,11 +12,14 @@ import (
 const (
 	varTypeInt = iota
 	varTypeIdent
+	varTypeIndex // only indexes the previous part, e.g. `[2]` of `Matrix[1][2]`
 )
 
 type IEvaluator interface {
 	GetPositionToken() *Token
+	// Evaluate evaluates against target as trusted input, see EvalOptions
 	Evaluate(target interface{}) (*Value, *Error)
+	evaluate(ctx *evalContext) (*Value, *Error)
 }
 
 type intResolver struct {
@@ -23,6 +28,10 @@ type intResolver struct {
 }
 
 func (i *intResolver) Evaluate(target interface{}) (*Value, *Error) {
+	return i.evaluate(newEvalContext(target, nil))
+}
+
+func (i *intResolver) evaluate(ctx *evalContext) (*Value, *Error) {
 	return AsValue(i.val), nil
 }
 
@@ -36,6 +45,10 @@ type stringResolver struct {
 }
 
 func (s *stringResolver) Evaluate(target interface{}) (*Value, *Error) {
+	return s.evaluate(newEvalContext(target, nil))
+}
+
+func (s *stringResolver) evaluate(ctx *evalContext) (*Value, *Error) {
 	return AsValue(s.val), nil
 }
 
@@ -49,6 +62,10 @@ type boolResolver struct {
 }
 
 func (b *boolResolver) Evaluate(target interface{}) (*Value, *Error) {
+	return b.evaluate(newEvalContext(target, nil))
+}
+
+func (b *boolResolver) evaluate(ctx *evalContext) (*Value, *Error) {
 	return AsValue(b.val), nil
 }
 
@@ -56,6 +73,145 @@ func (b *boolResolver) GetPositionToken() *Token {
 	return b.locationToken
 }
 
+// coalesceResolver evaluates to left, or to right when left is nil.
+// right is only evaluated when it's needed
+type coalesceResolver struct {
+	locationToken *Token
+	left          IEvaluator
+	right         IEvaluator
+}
+
+func (c *coalesceResolver) Evaluate(target interface{}) (*Value, *Error) {
+	return c.evaluate(newEvalContext(target, nil))
+}
+
+func (c *coalesceResolver) evaluate(ctx *evalContext) (*Value, *Error) {
+	lv, err := c.left.evaluate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !lv.IsNil() {
+		return lv, nil
+	}
+	return c.right.evaluate(ctx)
+}
+
+func (c *coalesceResolver) GetPositionToken() *Token {
+	return c.locationToken
+}
+
+// conditionalResolver evaluates `cond ? then : otherwise`, only the taken
+// branch is evaluated
+type conditionalResolver struct {
+	locationToken *Token
+	cond          IEvaluator
+	then          IEvaluator
+	otherwise     IEvaluator
+}
+
+func (c *conditionalResolver) Evaluate(target interface{}) (*Value, *Error) {
+	return c.evaluate(newEvalContext(target, nil))
+}
+
+func (c *conditionalResolver) evaluate(ctx *evalContext) (*Value, *Error) {
+	cv, err := c.cond.evaluate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cv.IsTrue() {
+		return c.then.evaluate(ctx)
+	}
+	return c.otherwise.evaluate(ctx)
+}
+
+func (c *conditionalResolver) GetPositionToken() *Token {
+	return c.locationToken
+}
+
+// compareResolver evaluates `left == right` or `left != right` to a bool
+type compareResolver struct {
+	locationToken *Token
+	left          IEvaluator
+	right         IEvaluator
+}
+
+func (c *compareResolver) Evaluate(target interface{}) (*Value, *Error) {
+	return c.evaluate(newEvalContext(target, nil))
+}
+
+func (c *compareResolver) evaluate(ctx *evalContext) (*Value, *Error) {
+	lv, err := c.left.evaluate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := c.right.evaluate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	equal := equalValues(lv, rv)
+	if c.locationToken.Val == "!=" {
+		return AsValue(!equal), nil
+	}
+	return AsValue(equal), nil
+}
+
+func (c *compareResolver) GetPositionToken() *Token {
+	return c.locationToken
+}
+
+// equalValues compares numbers (json.Number too) by value whatever their
+// kinds are, strings and bools ignoring named types, and anything else deeply
+func equalValues(a, b *Value) bool {
+	if ai, ok := integerText(a); ok {
+		if bi, ok := integerText(b); ok {
+			// Decimal form is exact for int64, uint64 and json.Number integers
+			return ai == bi
+		}
+	}
+	a, b = numberValue(a), numberValue(b)
+	av, bv := a.getResolvedValue(), b.getResolvedValue()
+	switch {
+	case !av.IsValid() || !bv.IsValid():
+		return av.IsValid() == bv.IsValid()
+	case a.IsNumber() && b.IsNumber():
+		return a.Float() == b.Float()
+	case a.IsString() && b.IsString():
+		return av.String() == bv.String()
+	case a.IsBool() && b.IsBool():
+		return av.Bool() == bv.Bool()
+	case av.CanInterface() && bv.CanInterface():
+		return reflect.DeepEqual(av.Interface(), bv.Interface())
+	}
+	return false
+}
+
+// integerText returns the decimal form of an integer or a json.Number
+// without fraction or exponent
+func integerText(v *Value) (string, bool) {
+	if v.IsInteger() {
+		return v.String(), true
+	}
+	n, ok := v.Interface().(json.Number)
+	if !ok || strings.ContainsAny(string(n), ".eE") {
+		return "", false
+	}
+	i, ok := new(big.Int).SetString(string(n), 10)
+	if !ok {
+		return "", false
+	}
+	return i.String(), true
+}
+
+// numberValue turns a json.Number into float64, so it compares as a number
+func numberValue(v *Value) *Value {
+	if n, ok := v.Interface().(json.Number); ok {
+		if f, err := n.Float64(); err == nil {
+			return AsValue(f)
+		}
+	}
+	return v
+}
+
 type variableResolver struct {
 	locationToken *Token
 
@@ -63,165 +219,411 @@ type variableResolver struct {
 }
 
 type functionCallArgument interface {
-	Evaluate(target interface{}) (*Value, *Error)
+	evaluate(ctx *evalContext) (*Value, *Error)
 }
 
 func (vr *variableResolver) Evaluate(target interface{}) (*Value, *Error) {
-	value, err := vr.resolve(target)
+	return vr.evaluate(newEvalContext(target, nil))
+}
+
+func (vr *variableResolver) evaluate(ctx *evalContext) (*Value, *Error) {
+	value, err := vr.resolve(ctx)
 	if err != nil {
-		return AsValue(nil), NewError(err.Error(), vr.locationToken)
+		return AsValue(nil), wrapError(err, vr.locationToken)
 	}
+	// Writes through this value report the last segment
+	value.token = vr.parts[len(vr.parts)-1].token
 	return value, nil
 }
 
 func (vr *variableResolver) String() string {
 	parts := make([]string, 0, len(vr.parts))
 	for _, p := range vr.parts {
-		switch p.typ {
-		case varTypeInt:
-			parts = append(parts, strconv.Itoa(p.i))
-		case varTypeIdent:
-			parts = append(parts, p.s)
-		default:
-			panic("unimplemented")
+		if p.typ == varTypeIndex {
+			parts[len(parts)-1] += p.indexString()
+			continue
 		}
+		parts = append(parts, p.String()+p.indexString())
 	}
 	return strings.Join(parts, ".")
 }
 
-func (vr *variableResolver) resolve(target interface{}) (*Value, error) {
+func (vr *variableResolver) resolve(ctx *evalContext) (value *Value, err error) {
 
 	var keySetter *KeySetter
-	current := reflect.ValueOf(target)
+	var part *variablePart
+	var path pathBuilder
+	var backs []writeBack
+	var slot reflect.Value       // settable interface current is unpacked from
+	var held *writeBack          // stores current itself when it's a copy unpacked from an interface
+	inCopy := false              // current is in a copy of a map item
+	created := false             // a map key was added or a slice grown for an item navigated into
+	var nilEmbedded reflect.Type // type of the nil embedded struct current is read through
+	current := reflect.ValueOf(ctx.target)
+
+	// unpack unpacks current when it's an interface or a *Value, keySetter
+	// tells where current is kept
+	unpack := func() {
+		if current.IsValid() && current.Kind() == reflect.Interface {
+			if current.CanSet() {
+				slot = current
+			}
+			if !current.IsNil() {
+				current, held = unpackSlot(current, keySetter)
+			}
+		}
+		current = unpackValue(current)
+	}
+	// descend is called before navigating into current, which isn't the
+	// final value then
+	descend := func() {
+		if held != nil {
+			backs = append(backs, *held)
+			held = nil
+		}
+		slot = reflect.Value{}
+	}
+
+	defer func() {
+		// Expressions come from clients, bad input must not crash the caller,
+		// e.g. a panic in a called method
+		if r := recover(); r != nil {
+			token := vr.locationToken
+			if part != nil {
+				token = part.token
+			}
+			err = recoveredError(r, token)
+		}
+	}()
+
+	for i := range vr.parts {
+		part = vr.parts[i]
+		// Nothing is navigated after the index of the last segment
+		isLast := i == len(vr.parts)-1 && !part.isFunctionCall
+
+		if err := ctx.opts.checkContext(); err != nil {
+			return nil, err
+		}
+		descend()
+
+		// An index part handles nil itself, as an index call
+		isIndexPart := part.typ == varTypeIndex
+
+		if isNilValue(current) && !isIndexPart && ctx.writes() && !part.nullSafe && keySetter != nil {
+			// Create the missing item to write into, e.g. `Doc.new.key`
+			if back, ok := createMissing(keySetter, false); ok {
+				backs = append(backs, back)
+				current = back.item
+			}
+		}
+
+		if embedded := nilEmbedded; embedded != nil {
+			nilEmbedded = nil
+			if part.typ == varTypeIdent && !part.isIndexCall && !part.isFunctionCall {
+				// A field of a nil embedded struct named explicitly reads
+				// nil, like the same field promoted, e.g. `Base.ID`
+				field, err := lookupField(embedded, part.s)
+				if err != nil {
+					return nil, fmt.Errorf("%v (variable %s)", err, vr.String())
+				}
+				path.field(field.Name)
+				continue
+			}
+		}
+
+		// Navigating through a nil value is only allowed by `?.`, which
+		// short-circuits the rest of the expression to nil
+		if isNilValue(current) && !isIndexPart {
+			if part.nullSafe {
+				return AsValue(nil), nil
+			}
+			return nil, fmt.Errorf("Can't access '%s' on a nil value (variable %s), use '?.' for nil-tolerant access",
+				part.String(), vr.String())
+		}
 
-	for _, part := range vr.parts {
 		// Before resolving the pointer, let's see if we have a method to call
 		// Problem with resolving the pointer is we're changing the receiver
 		isFunc := false
+		owner := keySetter // where current is kept, if it's a map or slice item
 		keySetter = nil
-		if part.typ == varTypeIdent {
-			funcValue := current.MethodByName(part.s)
-			if funcValue.IsValid() {
-				current = funcValue
+		created = created || (owner != nil && owner.created)
+		var copyBack func()
+		_, isAccessor := accessorOf(current)
+		// An Accessor resolves its fields itself, only calls reach its methods
+		if part.typ == varTypeIdent && !part.quoted && (!isAccessor || part.isFunctionCall) {
+			recv, name, ok := current, "", false
+			if name, ok = methodName(recv, part.s, false); !ok && current.Kind() != reflect.Ptr {
+				// Pointer-receiver methods need the address of current
+				switch {
+				case current.CanAddr() && !inCopy:
+					recv = current.Addr()
+				case ctx.opts.CopyBackReceivers && current.CanAddr():
+					recv = current.Addr()
+					if !ctx.dryRun {
+						copied := &Value{backs: backs}
+						copyBack = copied.storeBack
+					}
+				case ctx.opts.CopyBackReceivers:
+					recv = reflect.New(current.Type())
+					recv.Elem().Set(current)
+					if owner != nil && owner.prev.val.Kind() == reflect.Map && !ctx.dryRun {
+						item := recv.Elem()
+						copyBack = func() { owner.prev.val.SetMapIndex(owner.key, item) }
+					}
+				}
+				name, ok = methodName(recv, part.s, false)
+			}
+			if !ok && !hasField(current.Type(), part.s) {
+				// Exact names win, then fields ignoring case, a method is
+				// matched ignoring case only when there's no such field
+				name, ok = methodName(recv, part.s, true)
+			}
+			if ok {
+				if !ctx.opts.Methods.allows(recv, name) {
+					return nil, &MethodDeniedError{Type: recv.Type(), Method: name}
+				}
+				current = recv.MethodByName(name)
 				isFunc = true
+				path.field(name)
+			} else {
+				copyBack = nil
 			}
 		}
 
 		if !isFunc {
+			if owner != nil && owner.prev.val.Kind() == reflect.Map && !current.CanAddr() {
+				switch current.Kind() {
+				case reflect.Struct, reflect.Array:
+					// Map items can't be changed in place, navigate a copy
+					// which is stored back into the map after a write
+					item := reflect.New(current.Type()).Elem()
+					item.Set(current)
+					backs = append(backs, writeBack{m: owner.prev.val, key: owner.key, item: item})
+					current = item
+					inCopy = true
+				}
+			}
+
 			// If current a pointer, resolve it
 			if current.Kind() == reflect.Ptr {
 				current = current.Elem()
-				if !current.IsValid() {
-					// Value is not valid (anymore)
-					return AsValue(nil), nil
-				}
+				inCopy = false
 			}
 
 			// Look up which part must be called now
-			switch part.typ {
-			case varTypeInt:
+			acc, isAccessor := accessorOf(current)
+			switch {
+			case isAccessor && part.typ != varTypeIndex:
+				// Types wrapping their data navigate themselves
+				key := AsValue(part.s)
+				if part.typ == varTypeInt {
+					key = AsValue(part.i)
+				}
+				current, keySetter, err = access(acc, current, key)
+				if err != nil {
+					return nil, fmt.Errorf("%v (variable %s)", err, vr.String())
+				}
+				inCopy = false
+				if part.typ == varTypeInt {
+					path.index(keySetter.key)
+				} else {
+					path.field(part.s)
+				}
+			case part.typ == varTypeInt:
 				// Calling an index is only possible for:
 				// * slices/arrays/strings
 				switch current.Kind() {
 				case reflect.String, reflect.Array, reflect.Slice:
+					// Slice items are shared with the original
+					inCopy = inCopy && current.Kind() == reflect.Array
 					if current.Len() > part.i {
 						current = current.Index(part.i)
+						path.index(reflect.ValueOf(part.i))
 					} else {
-						return nil, fmt.Errorf("Index out of range: %d (variable %s)", part.i, vr.String())
+						return nil, indexOutOfRange(current, part.i, vr)
+					}
+				case reflect.Map:
+					key, err := mapKey(current, AsValue(part.i))
+					if err != nil {
+						return nil, fmt.Errorf("%v (variable %s)", err, vr.String())
 					}
+					keySetter = &KeySetter{prev: &Value{val: current}, key: key}
+					current = current.MapIndex(key)
+					keySetter.created = !current.IsValid()
+					path.index(key)
 				default:
 					return nil, fmt.Errorf("Can't access an index on type %s (variable %s)",
 						current.Kind().String(), vr.String())
 				}
-			case varTypeIdent:
+			case part.typ == varTypeIdent:
 				// debugging:
 				// fmt.Printf("now = %s (kind: %s)\n", part.s, current.Kind().String())
 
 				// Calling a field or key
 				switch current.Kind() {
 				case reflect.Struct:
-					current = current.FieldByName(part.s)
+					field, err := lookupField(current.Type(), part.s)
+					if err != nil {
+						return nil, fmt.Errorf("%v (variable %s)", err, vr.String())
+					}
+					current, err = fieldByIndex(current, field.Index, ctx)
+					if err == nil && field.Anonymous && !isLast && current.Kind() == reflect.Ptr {
+						// Navigating through the embedded struct named explicitly, e.g. `Base.ID`
+						embedded := current.Type().Elem()
+						if current, err = allocEmbedded(current, ctx); err == nil && !current.IsValid() {
+							nilEmbedded = embedded
+						}
+					}
+					if err != nil {
+						return nil, fmt.Errorf("%v (variable %s)", err, vr.String())
+					}
+					path.field(field.Name)
 				case reflect.Map:
-					current = current.MapIndex(reflect.ValueOf(part.s))
+					key, err := mapKey(current, AsValue(part.s))
+					if err != nil {
+						return nil, fmt.Errorf("%v (variable %s)", err, vr.String())
+					}
+					keySetter = &KeySetter{prev: &Value{val: current}, key: key}
+					current = current.MapIndex(key)
+					keySetter.created = !current.IsValid()
+					if keySetter.created && !part.quoted {
+						// Map keys match exactly, a name differing only in case is a mistake
+						if similar, ok := similarKey(keySetter.prev.val, part.s); ok {
+							return nil, fmt.Errorf("Can't find key '%s' in map, keys are case-sensitive, did you mean '%s'? (variable %s)",
+								part.s, similar, vr.String())
+						}
+					}
+					path.index(key)
 				default:
 					return nil, fmt.Errorf("Can't access a field by name on type %s (variable %s)",
 						current.Kind().String(), vr.String())
 				}
+			case part.typ == varTypeIndex:
+				// Nothing to look up, the index call follows
 			default:
 				panic("unimplemented")
 			}
 		}
 
-		if !current.IsValid() {
-			// Value is not valid (anymore)
-			return AsValue(nil), nil
-		}
-
-		// If current is a reflect.ValueOf(Value), then unpack it
-		// Happens in function calls (as a return value) or by injecting
-		// into the execution context (e.g. in a for-loop)
-		if current.Type() == reflect.TypeOf(&Value{}) {
-			tmpValue := current.Interface().(*Value)
-			current = tmpValue.val
-		}
-
-		// Check whether this is an interface and resolve it where required
-		if current.Kind() == reflect.Interface {
-			current = reflect.ValueOf(current.Interface())
-		}
+		unpack()
 
 		// Handle index call
 		if part.isIndexCall {
+			descend()
+			created = created || (keySetter != nil && keySetter.created)
 
-			if current.Kind() != reflect.String && current.Kind() != reflect.Array && current.Kind() != reflect.Slice && current.Kind() != reflect.Map {
+			creator := keySetter // where a missing current is created
+			if isIndexPart {
+				creator = owner
+			}
+			if isNilValue(current) && ctx.writes() && !part.indexNullSafe && creator != nil {
+				// Create the missing item to write into, e.g. `Doc.list[+]`
+				asSlice := part.isAppend
+				if !asSlice {
+					idxVal, err := part.indexArg.evaluate(ctx)
+					if err != nil {
+						return nil, err
+					}
+					asSlice = idxVal.IsInteger()
+				}
+				if back, ok := createMissing(creator, asSlice); ok {
+					backs = append(backs, back)
+					current = back.item
+				}
+			}
+
+			if isNilValue(current) {
+				if part.indexNullSafe {
+					return AsValue(nil), nil
+				}
+				return nil, fmt.Errorf("Can't access an index on a nil value (variable %s), use '?[' for nil-tolerant access",
+					vr.String())
+			}
+
+			acc, isAccessor := accessorOf(current)
+			if !isAccessor && current.Kind() != reflect.String && current.Kind() != reflect.Array && current.Kind() != reflect.Slice && current.Kind() != reflect.Map {
 				return nil, fmt.Errorf("'%s' can not be index access (it is %s)", vr.String(), current.Kind().String())
 			}
 
-			idxVal, err := part.indexArg.Evaluate(target)
-			if err != nil {
-				return nil, err
+			var idxVal *Value
+			if part.isAppend {
+				// `[+]` is the index right after the last item
+				if isAccessor || current.Kind() != reflect.Slice {
+					return nil, fmt.Errorf("Can't append to type %s (variable %s)", current.Kind().String(), vr.String())
+				}
+				idxVal = AsValue(current.Len())
+			} else {
+				var err *Error
+				idxVal, err = part.indexArg.evaluate(ctx)
+				if err != nil {
+					return nil, err
+				}
 			}
 
-			switch current.Kind() {
-			case reflect.String, reflect.Array, reflect.Slice:
-				currentLen := current.Len()
-				resolveKey := idxVal.getResolvedValue()
-				if currentLen > idxVal.Integer() {
-					current = current.Index(idxVal.Integer())
-					keySetter = &KeySetter{
-						prev: &Value{val: current},
-						key:  resolveKey,
-					}
+			switch kind := current.Kind(); {
+			case isAccessor:
+				current, keySetter, err = access(acc, current, idxVal)
+				if err != nil {
+					return nil, fmt.Errorf("%v (variable %s)", err, vr.String())
+				}
+				inCopy = false
+				path.index(keySetter.key)
+			case kind == reflect.String || kind == reflect.Array || kind == reflect.Slice:
+				if !idxVal.IsInteger() || idxVal.Integer() < 0 {
+					return nil, fmt.Errorf("Invalid index %v (variable %s)", idxVal.Interface(), vr.String())
+				}
+				idxInt := idxVal.Integer()
+				inCopy = inCopy && current.Kind() == reflect.Array
+				keySetter = &KeySetter{
+					prev: &Value{val: current},
+					key:  reflect.ValueOf(idxInt),
+				}
+				path.index(keySetter.key)
+				if current.Len() > idxInt {
+					current = current.Index(idxInt)
 				} else {
 					if current.Kind() != reflect.Slice {
-						return nil, fmt.Errorf("Index out of range: %d (variable %s)", idxVal.Integer(), vr.String())
+						return nil, indexOutOfRange(current, idxInt, vr)
 					}
-					idxInt := int(idxVal.Integer())
 					wantLen := idxInt + 1
-					if wantLen > current.Cap() {
-						nav := reflect.MakeSlice(current.Type(), wantLen, wantLen*2)
-						reflect.Copy(nav, current)
-						current.Set(nav)
-						current.SetLen(wantLen)
-					} else {
-						current.SetLen(wantLen)
+					if ctx.writes() {
+						// A read past the end is nil whatever the index, setValue
+						// checks the limit when it grows the slice
+						if err := checkLimit("slice growth", wantLen-current.Len(), ctx.opts.MaxSliceGrowth, DefaultMaxSliceGrowth); err != nil {
+							return nil, err
+						}
 					}
-					current = current.Index(idxInt)
-					keySetter = &KeySetter{
-						prev: &Value{val: current},
-						key:  resolveKey,
+					keySetter.created = true
+					keySetter.maxGrowth = ctx.opts.MaxSliceGrowth
+					switch {
+					case isLast:
+						// The item is nil for reading, SetValue grows the slice for it
+						current = reflect.Value{}
+					case ctx.dryRun:
+						// Preview a new item without growing the slice
+						current = reflect.New(current.Type().Elem()).Elem()
+					case ctx.write:
+						if !current.CanSet() {
+							return nil, fmt.Errorf("Index out of range: %d, slice can't grow (variable %s)", idxInt, vr.String())
+						}
+						current = growSlice(current, wantLen).Index(idxInt)
+					default:
+						// Reading never changes the target
+						current = reflect.Value{}
 					}
 				}
-			case reflect.Map:
-				resolveKey := idxVal.getResolvedValue()
-				if idxVal.IsInteger() {
-					resolveKey = reflect.ValueOf(idxVal.String())
+			case kind == reflect.Map:
+				resolveKey, err := mapKey(current, idxVal)
+				if err != nil {
+					return nil, fmt.Errorf("%v (variable %s)", err, vr.String())
 				}
 				keySetter = &KeySetter{
 					prev: &Value{val: current},
 					key:  resolveKey,
 				}
 				current = current.MapIndex(resolveKey)
+				keySetter.created = !current.IsValid()
+				path.index(resolveKey)
 			default:
 				return nil, fmt.Errorf("Can't access an index on type %s (variable %s)",
 					current.Kind().String(), vr.String())
@@ -235,6 +637,10 @@ func (vr *variableResolver) resolve(target interface{}) (*Value, error) {
 			if current.Kind() != reflect.Func {
 				return nil, fmt.Errorf("'%s' is not a function (it is %s)", vr.String(), current.Kind().String())
 			}
+			if !isFunc && !ctx.opts.Methods.allows(reflect.Value{}, part.String()) {
+				// A func value kept in a field or map item
+				return nil, &MethodDeniedError{Type: current.Type(), Method: part.String()}
+			}
 
 			// Check for correct function syntax and types
 			// func(*Value, ...) *Value
@@ -260,7 +666,7 @@ func (vr *variableResolver) resolve(target interface{}) (*Value, error) {
 			var fnArg reflect.Type
 
 			for idx, arg := range part.callingArgs {
-				pv, err := arg.Evaluate(target)
+				pv, err := arg.evaluate(ctx)
 				if err != nil {
 					return nil, err
 				}
@@ -305,8 +711,18 @@ func (vr *variableResolver) resolve(target interface{}) (*Value, error) {
 				}
 			}
 
+			ctx.calls++
+			if err := checkLimit("function calls", ctx.calls, ctx.opts.MaxFunctionCalls, DefaultMaxFunctionCalls); err != nil {
+				return nil, err
+			}
+
+			path.call(parameters)
+
 			// Call it and get first return parameter back
 			rv := current.Call(parameters)[0]
+			if copyBack != nil {
+				copyBack()
+			}
 
 			if rv.Type() != reflect.TypeOf(new(Value)) {
 				current = reflect.ValueOf(rv.Interface())
@@ -315,14 +731,265 @@ func (vr *variableResolver) resolve(target interface{}) (*Value, error) {
 				current = rv.Interface().(*Value).val
 			}
 		}
+
+		unpack()
+	}
+
+	if isOptional(current) {
+		// Read the value an optional wrapper holds, writes replace the wrapper
+		if !slot.IsValid() && current.CanSet() {
+			slot = current
+		}
+		current = unwrapOptional(current)
 	}
 
 	if !current.IsValid() {
 		// Value is not valid (e. g. NIL value)
-		return AsValueWithSetter(nil, keySetter), nil
+		return &Value{keySetter: keySetter, path: path.String(), backs: backs, slot: slot, created: created}, nil
+	}
+
+	return &Value{val: current, keySetter: keySetter, path: path.String(), backs: backs, held: held, slot: slot, created: created}, nil
+}
+
+// pathBuilder renders canonical path of resolved segments, e.g.
+// `Comments["1"].NickName` for `comments[commentIds[0]].nickName`
+type pathBuilder []string
+
+func (b *pathBuilder) field(name string) {
+	if len(*b) > 0 {
+		*b = append(*b, ".")
+	}
+	*b = append(*b, name)
+}
+
+func (b *pathBuilder) index(key reflect.Value) {
+	*b = append(*b, "[", formatLiteral(key), "]")
+}
+
+func (b *pathBuilder) call(args []reflect.Value) {
+	items := make([]string, 0, len(args))
+	for _, arg := range args {
+		items = append(items, formatLiteral(arg))
+	}
+	*b = append(*b, "(", strings.Join(items, ", "), ")")
+}
+
+func (b pathBuilder) String() string {
+	return strings.Join(b, "")
+}
+
+// formatLiteral renders v the way it's written in an expression
+func formatLiteral(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return strconv.Quote(v.String())
+	}
+	if v.CanInterface() {
+		return fmt.Sprint(v.Interface())
+	}
+	return v.String()
+}
+
+// methodName finds the method of v called name, or with fold named like it
+// ignoring case unless v is a map, whose names are keys matched exactly
+func methodName(v reflect.Value, name string, fold bool) (string, bool) {
+	if v.MethodByName(name).IsValid() {
+		return name, true
+	}
+	if !fold || reflect.Indirect(v).Kind() == reflect.Map {
+		return "", false
+	}
+	for i := 0; i < v.NumMethod(); i++ {
+		if m := v.Type().Method(i); strings.EqualFold(m.Name, name) {
+			return m.Name, true
+		}
+	}
+	return "", false
+}
+
+// similarKey finds a string key of m equal to key ignoring case
+func similarKey(m reflect.Value, key string) (string, bool) {
+	if m.Type().Key().Kind() != reflect.String {
+		return "", false
+	}
+	iter := m.MapRange()
+	for iter.Next() {
+		if k := iter.Key().String(); strings.EqualFold(k, key) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// indexOutOfRange reports idx past the end of string or array v, which
+// can't grow like a slice
+func indexOutOfRange(v reflect.Value, idx int, vr *variableResolver) error {
+	if v.Kind() == reflect.Array {
+		return fmt.Errorf("Index out of range: %d, array %s has fixed length %d (variable %s)", idx, v.Type(), v.Len(), vr.String())
+	}
+	return fmt.Errorf("Index out of range: %d (variable %s)", idx, vr.String())
+}
+
+// accessorOf returns the Accessor implemented by current, or by its address
+func accessorOf(current reflect.Value) (Accessor, bool) {
+	if isNilValue(current) || !current.CanInterface() {
+		return nil, false
+	}
+	if acc, ok := current.Interface().(Accessor); ok {
+		return acc, true
+	}
+	if current.CanAddr() {
+		acc, ok := current.Addr().Interface().(Accessor)
+		return acc, ok
+	}
+	return nil, false
+}
+
+// access gets item key of current by its Accessor acc, the returned
+// KeySetter sets it back by acc
+func access(acc Accessor, current reflect.Value, key *Value) (reflect.Value, *KeySetter, error) {
+	item, err := acc.ELGet(key)
+	if err != nil {
+		return reflect.Value{}, nil, err
+	}
+	keySetter := &KeySetter{prev: &Value{val: current}, key: key.val, accessor: acc}
+	if item != nil {
+		current = item.val
+	} else {
+		current = reflect.Value{}
+	}
+	keySetter.created = !current.IsValid()
+	return current, keySetter, nil
+}
+
+// unpackSlot unpacks interface current into the value it holds. Slices,
+// structs and arrays held can't be changed in place, so they're copied and
+// the returned writeBack stores the copy back into the interface's slot,
+// owner is where current is kept
+func unpackSlot(current reflect.Value, owner *KeySetter) (reflect.Value, *writeBack) {
+	elem := current.Elem()
+	switch elem.Kind() {
+	case reflect.Slice, reflect.Struct, reflect.Array:
+	default:
+		return elem, nil
+	}
+	back := &writeBack{}
+	switch {
+	case current.CanSet():
+		back.slot = current
+	case owner != nil && owner.prev.val.Kind() == reflect.Map:
+		back.m, back.key = owner.prev.val, owner.key
+	default:
+		// Nowhere to store it back
+		return elem, nil
+	}
+	back.item = reflect.New(elem.Type()).Elem()
+	back.item.Set(elem)
+	return back.item, back
+}
+
+// createMissing makes an empty item for the nil or missing item of owner,
+// so it can be navigated into for writing. An interface{} item becomes
+// map[string]interface{}, or []interface{} when asSlice
+func createMissing(owner *KeySetter, asSlice bool) (writeBack, bool) {
+	if owner.accessor != nil {
+		// Only the accessor knows what its items are
+		return writeBack{}, false
+	}
+	container := owner.prev.getResolvedValue()
+	typ := container.Type().Elem()
+	back := writeBack{}
+	switch typ.Kind() {
+	case reflect.Interface:
+		if typ.NumMethod() > 0 {
+			return back, false
+		}
+		if asSlice {
+			back.item = reflect.New(reflect.TypeOf([]interface{}{})).Elem()
+		} else {
+			back.item = reflect.ValueOf(map[string]interface{}{})
+		}
+	case reflect.Map:
+		back.item = reflect.MakeMap(typ)
+	case reflect.Ptr:
+		if typ.Elem().Kind() != reflect.Struct {
+			return back, false
+		}
+		back.item = reflect.New(typ.Elem())
+	case reflect.Struct, reflect.Array, reflect.Slice:
+		back.item = reflect.New(typ).Elem()
+	default:
+		return back, false
+	}
+
+	switch idx := owner.key; {
+	case container.Kind() == reflect.Map:
+		back.m, back.key = container, idx
+	case int(idx.Int()) < container.Len():
+		back.slot = container.Index(int(idx.Int()))
+	default:
+		// A detached item of dry run, never stored
+		back.slot = reflect.New(typ).Elem()
+	}
+	return back, true
+}
+
+// growSlice makes settable slice s n items long
+func growSlice(s reflect.Value, n int) reflect.Value {
+	if n > s.Cap() {
+		nav := reflect.MakeSlice(s.Type(), n, n*2)
+		reflect.Copy(nav, s)
+		s.Set(nav)
+	} else {
+		s.SetLen(n)
+	}
+	return s
+}
+
+// mapKey converts key to the key type of map m, integers are also
+// accepted for string keys
+func mapKey(m reflect.Value, key *Value) (reflect.Value, error) {
+	keyType := m.Type().Key()
+	if key.IsNil() {
+		return reflect.Value{}, fmt.Errorf("Can't use nil as key of %s", m.Type())
+	}
+	if keyType.Kind() == reflect.String && key.IsInteger() {
+		return reflect.ValueOf(key.String()).Convert(keyType), nil
+	}
+	return convertValue(key.getResolvedValue().Interface(), keyType)
+}
+
+// unpackValue resolves *Value and interface wrappers so the resolver can
+// navigate the underlying data
+func unpackValue(current reflect.Value) reflect.Value {
+	if !current.IsValid() {
+		return current
+	}
+
+	// If current is a reflect.ValueOf(Value), then unpack it
+	// Happens in function calls (as a return value) or by injecting
+	// into the execution context (e.g. in a for-loop)
+	if current.Type() == reflect.TypeOf(&Value{}) {
+		tmpValue := current.Interface().(*Value)
+		current = tmpValue.val
+	}
+
+	// Check whether this is an interface and resolve it where required
+	if current.Kind() == reflect.Interface {
+		current = reflect.ValueOf(current.Interface())
 	}
+	return current
+}
 
-	return &Value{val: current, keySetter: keySetter}, nil
+// isNilValue reports whether current can't be navigated any further
+func isNilValue(current reflect.Value) bool {
+	if !current.IsValid() {
+		return true
+	}
+	switch current.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return current.IsNil()
+	}
+	return false
 }
 
 func (vr *variableResolver) GetPositionToken() *Token {
@@ -330,17 +997,135 @@ func (vr *variableResolver) GetPositionToken() *Token {
 }
 
 type variablePart struct {
-	typ int
-	s   string
-	i   int
-
+	typ   int
+	s     string
+	i     int
+	token *Token
+
+	quoted         bool // `."name"`, a field or key which is never a method
+	nullSafe       bool // reached by `?.`
+	indexNullSafe  bool // index call opened by `?[`
+	isAppend       bool // index call is `[+]` or `[-]`
 	isIndexCall    bool
 	isFunctionCall bool
 	indexArg       functionCallArgument
+	indexSrc       string                 // indexArg as written, for messages
 	callingArgs    []functionCallArgument // needed for a function call, represents all argument nodes (INode supports nested function calls)
 }
 
+func (p *variablePart) String() string {
+	switch p.typ {
+	case varTypeInt:
+		return strconv.Itoa(p.i)
+	case varTypeIndex:
+		return p.indexString()
+	}
+	if p.quoted {
+		return strconv.Quote(p.s)
+	}
+	return p.s
+}
+
+// indexString renders the index call of p, e.g. `[CommentIds[0]]`
+func (p *variablePart) indexString() string {
+	if !p.isIndexCall {
+		return ""
+	}
+	open := "["
+	if p.indexNullSafe {
+		open = "?["
+	}
+	if p.isAppend {
+		return open + "+]"
+	}
+	return open + p.indexSrc + "]"
+}
+
+// ParseExp parses a whole expression:
+//
+//	exp        := comparison [ '?' exp ':' exp ]
+//	comparison := coalesce [ ( '==' | '!=' ) coalesce ]
+//	coalesce   := operand { '??' operand }
 func (p *Parser) ParseExp() (IEvaluator, *Error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if err := checkLimit("expression depth", p.depth, p.maxDepth, DefaultMaxDepth); err != nil {
+		e := p.Error(err.Error(), nil)
+		e.Err = err
+		return nil, e
+	}
+
+	cond, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.Match(TokenSymbol, "?")
+	if t == nil {
+		return cond, nil
+	}
+	then, err := p.ParseExp()
+	if err != nil {
+		return nil, err
+	}
+	if p.Match(TokenSymbol, ":") == nil {
+		return nil, p.Error("Expected ':' in conditional expression.", nil)
+	}
+	otherwise, err := p.ParseExp()
+	if err != nil {
+		return nil, err
+	}
+	return &conditionalResolver{
+		locationToken: t,
+		cond:          cond,
+		then:          then,
+		otherwise:     otherwise,
+	}, nil
+}
+
+func (p *Parser) parseComparison() (IEvaluator, *Error) {
+	left, err := p.parseCoalesce()
+	if err != nil {
+		return nil, err
+	}
+	t := p.MatchOne(TokenSymbol, "==", "!=")
+	if t == nil {
+		return left, nil
+	}
+	right, err := p.parseCoalesce()
+	if err != nil {
+		return nil, err
+	}
+	return &compareResolver{
+		locationToken: t,
+		left:          left,
+		right:         right,
+	}, nil
+}
+
+func (p *Parser) parseCoalesce() (IEvaluator, *Error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.Match(TokenSymbol, "??")
+		if t == nil {
+			return left, nil
+		}
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		left = &coalesceResolver{
+			locationToken: t,
+			left:          left,
+			right:         right,
+		}
+	}
+}
+
+func (p *Parser) parseOperand() (IEvaluator, *Error) {
 
 	if p.Match(TokenSymbol, "(") != nil {
 		expr, err := p.ParseExp()
@@ -407,8 +1192,9 @@ func (p *Parser) ParseExp() (IEvaluator, *Error) {
 	}
 
 	resolver.parts = append(resolver.parts, &variablePart{
-		typ: varTypeIdent,
-		s:   t.Val,
+		typ:   varTypeIdent,
+		s:     t.Val,
+		token: t,
 	})
 
 	p.Consume()
@@ -417,14 +1203,18 @@ variableLoop:
 	for p.Remaining() > 0 {
 		t = p.Current()
 
-		if p.Match(TokenSymbol, ".") != nil {
+		if dot := p.MatchOne(TokenSymbol, ".", "?."); dot != nil {
 			t2 := p.Current()
 			if t2 != nil {
 				switch t2.Typ {
-				case TokenIdentifier:
+				case TokenIdentifier, TokenString:
+					// A quoted name can hold any character, e.g. `Comments."my.key"`
 					resolver.parts = append(resolver.parts, &variablePart{
-						typ: varTypeIdent,
-						s:   t2.Val,
+						typ:      varTypeIdent,
+						s:        t2.Val,
+						token:    t2,
+						quoted:   t2.Typ == TokenString,
+						nullSafe: dot.Val == "?.",
 					})
 					p.Consume()
 					continue variableLoop
@@ -434,8 +1224,10 @@ variableLoop:
 						return nil, p.Error(err.Error(), t2)
 					}
 					resolver.parts = append(resolver.parts, &variablePart{
-						typ: varTypeInt,
-						i:   i,
+						typ:      varTypeInt,
+						i:        i,
+						token:    t2,
+						nullSafe: dot.Val == "?.",
 					})
 					p.Consume()
 					continue variableLoop
@@ -482,20 +1274,36 @@ variableLoop:
 			}
 			// We're done parsing the function call, next variable part
 			continue variableLoop
-		} else if p.Match(TokenSymbol, "[") != nil {
+		} else if bracket := p.MatchOne(TokenSymbol, "[", "?["); bracket != nil {
 			part := resolver.parts[len(resolver.parts)-1]
+			if part.isIndexCall || part.isFunctionCall {
+				// Another index, e.g. `Matrix[1][2]` or `FindImages()[0]`
+				part = &variablePart{typ: varTypeIndex, token: bracket}
+				resolver.parts = append(resolver.parts, part)
+			}
 			part.isIndexCall = true
+			part.indexNullSafe = bracket.Val == "?["
 			if p.Remaining() == 0 {
 				return nil, p.Error("Unexpected EOF, expected index call expression.", p.lastToken)
 			}
 			if p.Peek(TokenSymbol, "]") != nil {
 				return nil, p.Error("Unexpected ], expected index argument.", p.lastToken)
 			}
+			if p.MatchOne(TokenSymbol, "+", "-") != nil {
+				// Append: `[+]`, or `[-]` as in JSON Pointer
+				part.isAppend = true
+				if p.Match(TokenSymbol, "]") == nil {
+					return nil, p.Error("Expected ] after append index.", nil)
+				}
+				continue variableLoop
+			}
+			start := p.idx
 			exprArg, err := p.ParseExp()
 			if err != nil {
 				return nil, err
 			}
 			part.indexArg = exprArg
+			part.indexSrc = sourceOf(p.tokens[start:p.idx])
 			if p.Match(TokenSymbol, "]") == nil {
 				return nil, p.Error("Miss [ for index argument call.", p.lastToken)
 			}
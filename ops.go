@@ -0,0 +1,508 @@
+package el
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Op is a Patch value which does something else than replacing the
+// property of its path, e.g. Insert(v), Remove() or Inc(1)
+type Op interface {
+	// apply applies op to v and returns the changes, starting from change
+	// which has path and old value of v filled
+	apply(ctx *evalContext, v *Value, change *Change) ([]Change, error)
+}
+
+type insertOp struct {
+	value interface{}
+}
+
+// Insert inserts value at the index of its slice item path, the item there
+// and later ones are shifted, e.g. Patch{"CommentIds[0]": Insert(uint64(9))}
+func Insert(value interface{}) Op {
+	return &insertOp{value: value}
+}
+
+func (op *insertOp) apply(ctx *evalContext, v *Value, change *Change) ([]Change, error) {
+	stored, err := v.insert(op.value, ctx.dryRun)
+	if err != nil {
+		return nil, err
+	}
+	change.OldValue = nil
+	change.NewValue = interfaceOf(reflect.Indirect(stored))
+	change.Created = true
+	return []Change{*change}, nil
+}
+
+type removeOp struct{}
+
+// Remove removes the slice item of its path, later items are shifted,
+// e.g. Patch{"CommentIds[0]": Remove()}
+func Remove() Op {
+	return &removeOp{}
+}
+
+func (op *removeOp) apply(ctx *evalContext, v *Value, change *Change) ([]Change, error) {
+	if err := v.remove(ctx.dryRun); err != nil {
+		return nil, err
+	}
+	return []Change{*change}, nil
+}
+
+type testOp struct {
+	value interface{}
+}
+
+// Test is a precondition entry like the `test` op of JSON Patch: the patch
+// is applied only when the property of its path equals value, otherwise
+// *PreconditionError is reported. It changes nothing itself
+func Test(value interface{}) Op {
+	return &testOp{value: value}
+}
+
+// apply does nothing, Patcher checks tests before the patch is applied
+func (op *testOp) apply(ctx *evalContext, v *Value, change *Change) ([]Change, error) {
+	return []Change{}, nil
+}
+
+// check reports *PreconditionError when the property of path in target doesn't equal value
+func (op *testOp) check(target interface{}, path Expression, opts *EvalOptions) error {
+	condition := Expression(fmt.Sprintf("%s == %#v", path, op.value))
+	v, err := path.executeIn(newEvalContext(target, opts))
+	if err != nil {
+		return &PreconditionError{Condition: condition, Err: err}
+	}
+	current := v.getResolvedValue()
+	equal := !current.IsValid() && op.value == nil
+	if current.IsValid() && op.value != nil {
+		// Convert value first, so e.g. a number decoded from JSON equals an int field
+		if cv, err := convertValue(op.value, current.Type()); err == nil {
+			equal = equalValues(AsValue(interfaceOf(cv)), AsValue(interfaceOf(current)))
+		}
+	}
+	if !equal {
+		return &PreconditionError{Condition: condition}
+	}
+	return nil
+}
+
+// setOp replaces the property, it's used for plain Patch values
+type setOp struct {
+	value interface{}
+}
+
+func (op *setOp) apply(ctx *evalContext, v *Value, change *Change) ([]Change, error) {
+	stored, err := v.setValue(op.value, ctx.dryRun)
+	if err != nil {
+		return nil, err
+	}
+	change.NewValue = interfaceOf(reflect.Indirect(stored))
+	return []Change{*change}, nil
+}
+
+// numberOp does arithmetic on a numeric property, a missing map key or
+// slice item counts as zero
+type numberOp struct {
+	name    string
+	operand interface{}
+}
+
+// Inc adds n to the numeric property, like `$inc` of MongoDB
+func Inc(n interface{}) Op {
+	return &numberOp{name: "$inc", operand: n}
+}
+
+// Mul multiplies the numeric property by n, like `$mul` of MongoDB
+func Mul(n interface{}) Op {
+	return &numberOp{name: "$mul", operand: n}
+}
+
+func (op *numberOp) apply(ctx *evalContext, v *Value, change *Change) ([]Change, error) {
+	typ, cur, err := v.currentOrZero()
+	if err != nil {
+		return nil, err
+	}
+	operand, err := numberOf(op.operand)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op.name, err)
+	}
+	if typ.Kind() == reflect.Interface {
+		// A missing item of a dynamic document takes the operand's type,
+		// numbers decoded from JSON are float64
+		typ = reflect.TypeOf(op.operand)
+		if typ == NumberType {
+			typ = reflect.TypeOf(float64(0))
+		}
+		cur = reflect.Zero(typ)
+	}
+
+	var result json.Number
+	switch {
+	case isIntKind(typ.Kind()), isUintKind(typ.Kind()):
+		a := new(big.Int)
+		if isIntKind(typ.Kind()) {
+			a.SetInt64(cur.Int())
+		} else {
+			a.SetUint64(cur.Uint())
+		}
+		b, err := parseInteger(string(operand))
+		if err != nil {
+			return nil, fmt.Errorf("%s: can not use %v with %s type, %v", op.name, operand, typ, err)
+		}
+		if op.name == "$inc" {
+			a.Add(a, b)
+		} else {
+			a.Mul(a, b)
+		}
+		result = json.Number(a.String())
+	case isFloatKind(typ.Kind()):
+		b, err := strconv.ParseFloat(string(operand), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", op.name, err)
+		}
+		f := cur.Float()
+		if op.name == "$inc" {
+			f += b
+		} else {
+			f *= b
+		}
+		result = json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+	default:
+		return nil, fmt.Errorf("%s: can not use it on %s type", op.name, typ)
+	}
+
+	// The result goes through the same conversion as SetNumber, which
+	// reports overflow of the property type
+	cv, err := convertValue(result, typ)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op.name, err)
+	}
+	stored, err := v.setValue(cv.Interface(), ctx.dryRun)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op.name, err)
+	}
+	change.NewValue = interfaceOf(reflect.Indirect(stored))
+	return []Change{*change}, nil
+}
+
+// compareOp keeps the smaller or larger one of the property and its value
+type compareOp struct {
+	name  string
+	value interface{}
+}
+
+// Min sets the property to value if value is less than it, like `$min`
+// of MongoDB. Numbers, strings and time.Time can be compared
+func Min(value interface{}) Op {
+	return &compareOp{name: "$min", value: value}
+}
+
+// Max sets the property to value if value is greater than it, like `$max` of MongoDB
+func Max(value interface{}) Op {
+	return &compareOp{name: "$max", value: value}
+}
+
+func (op *compareOp) apply(ctx *evalContext, v *Value, change *Change) ([]Change, error) {
+	typ, cur, err := v.currentOrZero()
+	if err != nil {
+		return nil, err
+	}
+	cv, err := convertValue(op.value, typ)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", op.name, err)
+	}
+	if !change.Created && typ.Kind() != reflect.Interface {
+		c, err := compareValues(cv, cur)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", op.name, err)
+		}
+		if (op.name == "$min" && c >= 0) || (op.name == "$max" && c <= 0) {
+			// Nothing changes
+			change.NewValue = change.OldValue
+			return []Change{*change}, nil
+		}
+	}
+	return (&setOp{value: cv.Interface()}).apply(ctx, v, change)
+}
+
+// compareValues returns -1, 0 or 1 when a is less than, equal to or greater than b
+func compareValues(a, b reflect.Value) (int, error) {
+	switch {
+	case a.Type() == reflect.TypeOf(time.Time{}) && b.Type() == a.Type():
+		ta, tb := a.Interface().(time.Time), b.Interface().(time.Time)
+		switch {
+		case ta.Before(tb):
+			return -1, nil
+		case ta.After(tb):
+			return 1, nil
+		}
+		return 0, nil
+	case isIntKind(a.Kind()) && isIntKind(b.Kind()):
+		return big.NewInt(a.Int()).Cmp(big.NewInt(b.Int())), nil
+	case isUintKind(a.Kind()) && isUintKind(b.Kind()):
+		return new(big.Int).SetUint64(a.Uint()).Cmp(new(big.Int).SetUint64(b.Uint())), nil
+	case isFloatKind(a.Kind()) && isFloatKind(b.Kind()):
+		return big.NewFloat(a.Float()).Cmp(big.NewFloat(b.Float())), nil
+	case a.Kind() == reflect.String && b.Kind() == reflect.String:
+		switch {
+		case a.String() < b.String():
+			return -1, nil
+		case a.String() > b.String():
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("can not compare %s with %s", a.Type(), b.Type())
+}
+
+// sliceOp adds or removes items of a slice property
+type sliceOp struct {
+	name   string
+	values []interface{}
+}
+
+// Push appends values to the slice property, like `$push` of MongoDB
+func Push(values ...interface{}) Op {
+	return &sliceOp{name: "$push", values: values}
+}
+
+// AddToSet appends values which are not in the slice property yet, like
+// `$addToSet` of MongoDB
+func AddToSet(values ...interface{}) Op {
+	return &sliceOp{name: "$addToSet", values: values}
+}
+
+// Pull removes all items equal to one of values from the slice property,
+// like `$pull` of MongoDB
+func Pull(values ...interface{}) Op {
+	return &sliceOp{name: "$pull", values: values}
+}
+
+func (op *sliceOp) apply(ctx *evalContext, v *Value, change *Change) ([]Change, error) {
+	typ, cur, err := v.currentOrZero()
+	if err != nil {
+		return nil, err
+	}
+	if typ.Kind() == reflect.Interface {
+		// A missing item of a dynamic document
+		typ = reflect.TypeOf([]interface{}{})
+		cur = reflect.Zero(typ)
+	}
+	if typ.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("%s: can not use it on %s type", op.name, typ)
+	}
+
+	items := make([]reflect.Value, 0, len(op.values))
+	for _, value := range op.values {
+		cv, err := convertValue(value, typ.Elem())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", op.name, err)
+		}
+		items = append(items, cv)
+	}
+
+	// Build a new slice, so the old value in change isn't touched
+	result := reflect.MakeSlice(typ, 0, cur.Len()+len(items))
+	switch op.name {
+	case "$push":
+		result = reflect.AppendSlice(result, cur)
+		result = reflect.Append(result, items...)
+	case "$addToSet":
+		result = reflect.AppendSlice(result, cur)
+		for _, item := range items {
+			if !containsItem(result, item) {
+				result = reflect.Append(result, item)
+			}
+		}
+	case "$pull":
+		for i := 0; i < cur.Len(); i++ {
+			pulled := false
+			for _, item := range items {
+				pulled = pulled || equalItems(cur.Index(i), item)
+			}
+			if !pulled {
+				result = reflect.Append(result, cur.Index(i))
+			}
+		}
+	}
+	return (&setOp{value: result.Interface()}).apply(ctx, v, change)
+}
+
+// containsItem reports whether an item of slice s is deeply equal to item
+func containsItem(s, item reflect.Value) bool {
+	for i := 0; i < s.Len(); i++ {
+		if equalItems(s.Index(i), item) {
+			return true
+		}
+	}
+	return false
+}
+
+// equalItems compares slice items like `==` does
+func equalItems(a, b reflect.Value) bool {
+	return equalValues(AsValue(interfaceOf(a)), AsValue(interfaceOf(b)))
+}
+
+type unsetOp struct{}
+
+// Unset removes the property, like `$unset` of MongoDB: a map key is
+// deleted, an Accessor item is set to nil, anything else is set to its
+// zero value
+func Unset() Op {
+	return &unsetOp{}
+}
+
+func (op *unsetOp) apply(ctx *evalContext, v *Value, change *Change) ([]Change, error) {
+	if change.Created {
+		// Nothing to remove
+		return []Change{}, nil
+	}
+	if v.keySetter != nil && v.keySetter.accessor != nil {
+		// The accessor decides what setting nil means
+		if _, err := v.setValue(nil, ctx.dryRun); err != nil {
+			return nil, err
+		}
+		return []Change{*change}, nil
+	}
+	if v.keySetter != nil && v.keySetter.prev.getResolvedValue().Kind() == reflect.Map {
+		if !ctx.dryRun {
+			v.keySetter.prev.getResolvedValue().SetMapIndex(v.keySetter.key, reflect.Value{})
+			v.storeBack()
+		}
+		return []Change{*change}, nil
+	}
+	typ, err := v.settableType()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := v.setValue(reflect.Zero(typ).Interface(), ctx.dryRun); err != nil {
+		return nil, err
+	}
+	return []Change{*change}, nil
+}
+
+type renameOp struct {
+	to Expression
+}
+
+// Rename moves the property to path to, like `$rename` of MongoDB
+func Rename(to Expression) Op {
+	return &renameOp{to: to}
+}
+
+func (op *renameOp) apply(ctx *evalContext, v *Value, change *Change) ([]Change, error) {
+	if change.Created {
+		// Nothing to move
+		return []Change{}, nil
+	}
+	toValue, err := op.to.executeIn(&evalContext{
+		target: ctx.target,
+		opts:   ctx.opts,
+		write:  ctx.write,
+		dryRun: ctx.dryRun,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if toValue.isMissing() {
+		return nil, &EntryError{Path: op.to, Err: fmt.Errorf("doesn't match any property in target")}
+	}
+	moved := change.OldValue
+	to := Change{Path: toValue.Path(), Created: toValue.isCreated()}
+	if !to.Created {
+		to.OldValue = interfaceOf(toValue.getResolvedValue())
+	}
+	toChanges, err := (&setOp{value: moved}).apply(ctx, toValue, &to)
+	if err != nil {
+		return nil, err
+	}
+	fromChanges, err := (&unsetOp{}).apply(ctx, v, change)
+	if err != nil {
+		return nil, err
+	}
+	return append(fromChanges, toChanges...), nil
+}
+
+// numberOf converts a Go or JSON number to json.Number
+func numberOf(n interface{}) (json.Number, error) {
+	rv := reflect.ValueOf(n)
+	switch {
+	case !rv.IsValid():
+	case rv.Type() == NumberType:
+		return rv.Interface().(json.Number), nil
+	case isIntKind(rv.Kind()):
+		return json.Number(strconv.FormatInt(rv.Int(), 10)), nil
+	case isUintKind(rv.Kind()):
+		return json.Number(strconv.FormatUint(rv.Uint(), 10)), nil
+	case isFloatKind(rv.Kind()):
+		return json.Number(strconv.FormatFloat(rv.Float(), 'g', -1, 64)), nil
+	}
+	return "", fmt.Errorf("%v is not a number", n)
+}
+
+// FromUpdate builds a Patch from a MongoDB-style update document whose
+// field paths are expressions, e.g. decoded from JSON:
+//
+//	{"$inc": {"Views": 1}, "$push": {"Tags": {"$each": ["go", "el"]}}}
+//
+// Supported operators are $set, $inc, $mul, $min, $max, $push, $pull,
+// $addToSet, $unset and $rename. A path can only be used by one operator
+func FromUpdate(update map[string]interface{}) (Patch, error) {
+	patch := Patch{}
+	for name, fields := range update {
+		m, ok := fields.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: expected an object of paths", name)
+		}
+		for path, value := range m {
+			var op interface{}
+			switch name {
+			case "$set":
+				op = value
+			case "$inc":
+				op = Inc(value)
+			case "$mul":
+				op = Mul(value)
+			case "$min":
+				op = Min(value)
+			case "$max":
+				op = Max(value)
+			case "$push":
+				op = Push(eachOf(value)...)
+			case "$addToSet":
+				op = AddToSet(eachOf(value)...)
+			case "$pull":
+				op = Pull(value)
+			case "$unset":
+				op = Unset()
+			case "$rename":
+				to, ok := value.(string)
+				if !ok {
+					return nil, fmt.Errorf("$rename: expected a path for %s", path)
+				}
+				op = Rename(Expression(to))
+			default:
+				return nil, fmt.Errorf("Unknown update operator %s", name)
+			}
+			if _, ok := patch[Expression(path)]; ok {
+				return nil, fmt.Errorf("%s: path %s is used by another operator", name, path)
+			}
+			patch[Expression(path)] = op
+		}
+	}
+	return patch, nil
+}
+
+// eachOf unpacks `{"$each": [...]}` of $push and $addToSet
+func eachOf(value interface{}) []interface{} {
+	if m, ok := value.(map[string]interface{}); ok && len(m) == 1 {
+		if each, ok := m["$each"].([]interface{}); ok {
+			return each
+		}
+	}
+	return []interface{}{value}
+}
@@ -0,0 +1,106 @@
+package el
+
+import (
+	"database/sql"
+	"reflect"
+	"sync"
+)
+
+// OptionalAdapter lets a wrapper type holding an optional value, like
+// sql.NullString, be read as the value it holds or nil, and be set from a
+// value or nil
+type OptionalAdapter interface {
+	// ValueType returns the type of the value held by wrapper type t
+	ValueType(t reflect.Type) reflect.Type
+	// Get returns the value held by wrapper w, ok is false when w holds nothing
+	Get(w reflect.Value) (v reflect.Value, ok bool)
+	// Set makes settable wrapper w hold v, or nothing when v is invalid
+	Set(w, v reflect.Value)
+}
+
+var optionals = struct {
+	sync.RWMutex
+	adapters map[reflect.Type]OptionalAdapter
+}{
+	adapters: map[reflect.Type]OptionalAdapter{
+		reflect.TypeOf(sql.NullString{}):  ValidField("String"),
+		reflect.TypeOf(sql.NullInt64{}):   ValidField("Int64"),
+		reflect.TypeOf(sql.NullInt32{}):   ValidField("Int32"),
+		reflect.TypeOf(sql.NullInt16{}):   ValidField("Int16"),
+		reflect.TypeOf(sql.NullByte{}):    ValidField("Byte"),
+		reflect.TypeOf(sql.NullFloat64{}): ValidField("Float64"),
+		reflect.TypeOf(sql.NullBool{}):    ValidField("Bool"),
+		reflect.TypeOf(sql.NullTime{}):    ValidField("Time"),
+	},
+}
+
+// RegisterOptional makes the type of sample an optional wrapper read and
+// set by adapter, e.g. RegisterOptional(sql.Null[Money]{}, ValidField("V")).
+// The database/sql null types are registered already
+func RegisterOptional(sample interface{}, adapter OptionalAdapter) {
+	optionals.Lock()
+	defer optionals.Unlock()
+	optionals.adapters[reflect.TypeOf(sample)] = adapter
+}
+
+// optionalAdapter returns the adapter registered for wrapper type typ
+func optionalAdapter(typ reflect.Type) (OptionalAdapter, bool) {
+	optionals.RLock()
+	defer optionals.RUnlock()
+	adapter, ok := optionals.adapters[typ]
+	return adapter, ok
+}
+
+// isOptional reports whether v is an optional wrapper
+func isOptional(v reflect.Value) bool {
+	if !v.IsValid() {
+		return false
+	}
+	_, ok := optionalAdapter(v.Type())
+	return ok
+}
+
+// unwrapOptional returns the value held by v when it's an optional wrapper,
+// invalid when it holds nothing. Anything else is returned as is
+func unwrapOptional(v reflect.Value) reflect.Value {
+	if !v.IsValid() {
+		return v
+	}
+	adapter, ok := optionalAdapter(v.Type())
+	if !ok {
+		return v
+	}
+	if inner, ok := adapter.Get(v); ok {
+		return inner
+	}
+	return reflect.Value{}
+}
+
+// ValidField adapts structs like sql.NullString, which hold their value in
+// the field name and tell whether they hold it by the bool field Valid
+func ValidField(name string) OptionalAdapter {
+	return validField(name)
+}
+
+type validField string
+
+func (f validField) ValueType(t reflect.Type) reflect.Type {
+	field, _ := t.FieldByName(string(f))
+	return field.Type
+}
+
+func (f validField) Get(w reflect.Value) (reflect.Value, bool) {
+	if !w.FieldByName("Valid").Bool() {
+		return reflect.Value{}, false
+	}
+	return w.FieldByName(string(f)), true
+}
+
+func (f validField) Set(w, v reflect.Value) {
+	if !v.IsValid() {
+		w.Set(reflect.Zero(w.Type()))
+		return
+	}
+	w.FieldByName(string(f)).Set(v)
+	w.FieldByName("Valid").SetBool(true)
+}
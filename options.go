@@ -0,0 +1,196 @@
+package el
+
+import (
+	"context"
+	"reflect"
+)
+
+// Default limits used by EvalOptions when a limit is left zero
+const (
+	DefaultMaxExpressionLength = 1024
+	DefaultMaxDepth            = 32
+	DefaultMaxSliceGrowth      = 1024
+	DefaultMaxPatchEntries     = 256
+	DefaultMaxFunctionCalls    = 64
+)
+
+// Unlimited turns a limit of EvalOptions off
+const Unlimited = -1
+
+// EvalOptions controls what an expression is allowed to do during evaluation.
+//
+// The zero value is meant for untrusted input (e.g. Patch keys from HTTP clients):
+// no method can be called and every limit takes its default. Expression.Execute
+// without options trusts the expression, it allows every method but still
+// enforces the default limits.
+type EvalOptions struct {
+	// Methods decides which methods can be called, nil denies all of them
+	// except the ones listed by MethodExposer
+	Methods *MethodPolicy
+
+	// MaxExpressionLength limits length of expression in bytes
+	MaxExpressionLength int
+	// MaxDepth limits nesting of brackets, index and call arguments
+	MaxDepth int
+	// MaxSliceGrowth limits how many items indexing past the end of a slice can add
+	MaxSliceGrowth int
+	// MaxPatchEntries limits entries of a Patch
+	MaxPatchEntries int
+	// MaxFunctionCalls limits function calls in an expression
+	MaxFunctionCalls int
+
+	// CopyBackReceivers lets pointer-receiver methods be called on values
+	// which aren't addressable, like map items or results of calls: the
+	// method is called on a copy, which is stored back into its map after
+	// the call
+	CopyBackReceivers bool
+
+	// Context cancels evaluation and patching when it's done
+	Context context.Context
+}
+
+// trustedOptions is used for expressions evaluated without options, every
+// method can be called but limits take their defaults
+func trustedOptions() *EvalOptions {
+	return &EvalOptions{Methods: AllowAllMethods()}
+}
+
+// checkLimit reports LimitError when n exceeds max, zero max means def
+func checkLimit(name string, n, max, def int) error {
+	if max == 0 {
+		max = def
+	}
+	if max != Unlimited && n > max {
+		return &LimitError{Limit: name, Max: max, Actual: n}
+	}
+	return nil
+}
+
+// checkContext reports error when Context of opts is done
+func (o *EvalOptions) checkContext() error {
+	if o.Context == nil {
+		return nil
+	}
+	return o.Context.Err()
+}
+
+// MethodExposer can be implemented by a type to list its methods which
+// can be called from any expression
+type MethodExposer interface {
+	ELMethods() []string
+}
+
+// MethodPolicy is an allowlist of methods which can be called from expressions.
+// Methods are allowed per name, per type or by implementing MethodExposer
+type MethodPolicy struct {
+	all   bool
+	names map[string]bool
+	types map[reflect.Type]map[string]bool
+}
+
+// NewMethodPolicy returns a policy which allows nothing, use AllowType and
+// AllowName to open methods
+func NewMethodPolicy() *MethodPolicy {
+	return &MethodPolicy{
+		names: map[string]bool{},
+		types: map[reflect.Type]map[string]bool{},
+	}
+}
+
+// AllowAllMethods returns a policy which allows calling any exported method
+func AllowAllMethods() *MethodPolicy {
+	return &MethodPolicy{all: true}
+}
+
+// AllowType allows methods of sample's type (pointer or not), all of them
+// when no method name is given
+func (mp *MethodPolicy) AllowType(sample interface{}, methods ...string) *MethodPolicy {
+	typ := indirectType(reflect.TypeOf(sample))
+	if len(methods) == 0 {
+		mp.types[typ] = nil
+		return mp
+	}
+	allowed, ok := mp.types[typ]
+	if ok && allowed == nil {
+		// All methods are allowed already
+		return mp
+	}
+	if allowed == nil {
+		allowed = map[string]bool{}
+		mp.types[typ] = allowed
+	}
+	for _, m := range methods {
+		allowed[m] = true
+	}
+	return mp
+}
+
+// AllowName allows methods with given names on any type
+func (mp *MethodPolicy) AllowName(names ...string) *MethodPolicy {
+	for _, n := range names {
+		mp.names[n] = true
+	}
+	return mp
+}
+
+// allows reports whether method name of recv can be called, recv is
+// invalid for func values which are not methods. Methods listed by
+// MethodExposer are allowed even by a nil policy
+func (mp *MethodPolicy) allows(recv reflect.Value, name string) bool {
+	if mp != nil && (mp.all || mp.names[name]) {
+		return true
+	}
+	if !recv.IsValid() {
+		return false
+	}
+	if mp != nil {
+		if allowed, ok := mp.types[indirectType(recv.Type())]; ok && (allowed == nil || allowed[name]) {
+			return true
+		}
+	}
+	if !recv.CanInterface() {
+		return false
+	}
+	if exposer, ok := recv.Interface().(MethodExposer); ok {
+		for _, m := range exposer.ELMethods() {
+			if m == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func indirectType(typ reflect.Type) reflect.Type {
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ
+}
+
+// evalContext carries target and options through one evaluation
+type evalContext struct {
+	target interface{}
+	opts   *EvalOptions
+	calls  int
+	write  bool // the resolved value is going to be written
+	dryRun bool // target must not be changed
+}
+
+// writes reports whether the resolved value is going to be written, for
+// real or in a dry run
+func (c *evalContext) writes() bool {
+	return c.write || c.dryRun
+}
+
+// newEvalContext creates context for evaluating target, nil opts means
+// trusted expression
+func newEvalContext(target interface{}, opts *EvalOptions) *evalContext {
+	if opts == nil {
+		opts = trustedOptions()
+	}
+	return &evalContext{
+		target: target,
+		opts:   opts,
+	}
+}
@@ -1,13 +1,20 @@
 package el
 
+import (
+	"strconv"
+	"strings"
+)
+
 type Parser struct {
 	idx       int
 	tokens    []*Token
 	lastToken *Token
+	depth     int
+	maxDepth  int // see EvalOptions.MaxDepth
 }
 
 func NewParser(tokens []*Token) *Parser {
-	p := &Parser{tokens: tokens}
+	p := &Parser{tokens: tokens, maxDepth: Unlimited}
 	if len(tokens) > 0 {
 		p.lastToken = tokens[len(tokens)-1]
 	}
@@ -133,3 +140,16 @@ func (p *Parser) Error(msg string, token *Token) *Error {
 		ErrorMsg: msg,
 	}
 }
+
+// sourceOf renders tokens back as they're written, without spaces
+func sourceOf(tokens []*Token) string {
+	items := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		if t.Typ == TokenString {
+			items = append(items, strconv.Quote(t.Val))
+		} else {
+			items = append(items, t.Val)
+		}
+	}
+	return strings.Join(items, "")
+}
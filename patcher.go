@@ -1,33 +1,220 @@
 package el
 
-import "fmt"
+import (
+	"errors"
+	"reflect"
+	"sort"
+)
 
 // Patch contains a group path and value
 type Patch map[Expression]interface{}
 
+// Reference is a Patch value which is read from Path of Source, or of the
+// patched target when Source is nil
+type Reference struct {
+	Path   Expression
+	Source interface{}
+}
+
+// Ref refers to path of the patched target, e.g.
+// Patch{"Author.Name": Ref(`Comments["0"].NickName`)}
+func Ref(path Expression) *Reference {
+	return &Reference{Path: path}
+}
+
+// RefIn refers to path of source
+func RefIn(source interface{}, path Expression) *Reference {
+	return &Reference{Path: path, Source: source}
+}
+
+// resolve reads the referred value, source is evaluated with opts like patch keys
+func (r *Reference) resolve(target interface{}, opts *EvalOptions) (interface{}, error) {
+	source := r.Source
+	if source == nil {
+		source = target
+	}
+	value, err := r.Path.executeIn(newEvalContext(source, opts))
+	if err != nil {
+		return nil, err
+	}
+	if value.isMissing() || (value.keySetter != nil && value.keySetter.created) {
+		return nil, &EntryError{Path: r.Path, Err: errors.New("doesn't match any property in source")}
+	}
+	// The snapshot must not change with later writes into the source
+	return interfaceOf(copyValue(value.getResolvedValue(), map[uintptr]reflect.Value{})), nil
+}
+
 // Patcher use to patch in memory struct with path
-type Patcher struct{}
+//
+// Patch keys usually come from clients, so they're evaluated with Options,
+// the zero Patcher doesn't allow any method call
+type Patcher struct {
+	Options EvalOptions
+}
+
+// Change records one property modified by a patch
+type Change struct {
+	// Path is the canonical path of the property, e.g. `Comments["1"].NickName`
+	Path     string      `json:"path"`
+	OldValue interface{} `json:"oldValue"`
+	NewValue interface{} `json:"newValue"`
+	// Created is true when a map key is added or a slice grows for the property
+	Created bool `json:"created"`
+}
+
+// ChangeSet lists changes of a patch in the order they are applied
+type ChangeSet []Change
 
 // PatchIt do patch work
 func (p *Patcher) PatchIt(target interface{}, patch Patch) error {
+	_, err := p.PatchItWithChanges(target, patch)
+	return err
+}
 
-	for path, value := range patch {
+// PatchItWithChanges do patch work like PatchIt, and reports what is changed.
+// Entries are applied in the order of their expressions
+func (p *Patcher) PatchItWithChanges(target interface{}, patch Patch) (ChangeSet, error) {
+	return p.apply(target, patch, nil, false)
+}
 
-		targetValue, err := path.Execute(target)
-		if err != nil {
-			return err
+// PatchIf do patch work like PatchItWithChanges when every precondition is
+// true for target, e.g. `Version == 7`, otherwise it reports *PreconditionError
+// and target isn't changed
+func (p *Patcher) PatchIf(target interface{}, patch Patch, preconditions ...Expression) (ChangeSet, error) {
+	return p.apply(target, patch, preconditions, false)
+}
+
+// DryRun checks patch against target without changing it: every path is
+// resolved, every value is converted and checked to be settable. It reports
+// the changes the patch would make, and all problems found as PatchErrors.
+//
+// Methods allowed by Options are still called, so they should have no side effect
+func (p *Patcher) DryRun(target interface{}, patch Patch) (ChangeSet, error) {
+	return p.apply(target, patch, nil, true)
+}
+
+func (p *Patcher) apply(target interface{}, patch Patch, preconditions []Expression, dryRun bool) (changes ChangeSet, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoveredError(r, nil)
+		}
+	}()
+
+	if err := checkLimit("patch entries", len(patch), p.Options.MaxPatchEntries, DefaultMaxPatchEntries); err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(patch))
+	for path := range patch {
+		paths = append(paths, string(path))
+	}
+	sort.Strings(paths)
+
+	for _, condition := range preconditions {
+		if err := p.checkPrecondition(target, condition); err != nil {
+			return nil, err
 		}
+	}
+
+	// Tests and references are read before anything is written, so all of
+	// them see the target as it was before the patch
+	values := make([]interface{}, len(paths))
+	valueErrs := make([]error, len(paths))
+	for i, path := range paths {
+		values[i] = patch[Expression(path)]
+		switch value := values[i].(type) {
+		case *Reference:
+			values[i], valueErrs[i] = value.resolve(target, &p.Options)
+			if valueErrs[i] != nil && !dryRun {
+				return nil, valueErrs[i]
+			}
+		case *testOp:
+			valueErrs[i] = value.check(target, Expression(path), &p.Options)
+			if valueErrs[i] != nil && !dryRun {
+				return nil, valueErrs[i]
+			}
+		}
+	}
 
-		if targetValue.IsNil() && targetValue.keySetter == nil {
-			return fmt.Errorf("path: %s doesn't match any property in target", path)
+	var errs PatchErrors
+	changes = make(ChangeSet, 0, len(patch))
+	for i, path := range paths {
+		if err := p.Options.checkContext(); err != nil {
+			return changes, err
 		}
 
-		err = targetValue.SetValue(value)
+		err := valueErrs[i]
+		if _, ok := values[i].(*testOp); ok && err == nil {
+			continue
+		}
+		var entryChanges []Change
+		if err == nil {
+			entryChanges, err = p.applyEntry(target, Expression(path), values[i], dryRun)
+		}
 		if err != nil {
-			return err
+			if !dryRun {
+				return changes, err
+			}
+			if _, ok := err.(*EntryError); !ok {
+				err = &EntryError{Path: Expression(path), Err: err}
+			}
+			errs = append(errs, err)
+			continue
 		}
+		changes = append(changes, entryChanges...)
+	}
 
+	if len(errs) > 0 {
+		return changes, errs
 	}
+	return changes, nil
+}
 
+// checkPrecondition reports *PreconditionError when condition isn't true for target
+func (p *Patcher) checkPrecondition(target interface{}, condition Expression) error {
+	value, err := condition.executeIn(newEvalContext(target, &p.Options))
+	if err != nil {
+		return &PreconditionError{Condition: condition, Err: err}
+	}
+	if !value.IsTrue() {
+		return &PreconditionError{Condition: condition}
+	}
 	return nil
 }
+
+func (p *Patcher) applyEntry(target interface{}, exp Expression, value interface{}, dryRun bool) ([]Change, error) {
+	ctx := newEvalContext(target, &p.Options)
+	ctx.write = !dryRun
+	ctx.dryRun = dryRun
+	targetValue, err := exp.executeIn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if targetValue.isMissing() {
+		return nil, &EntryError{Path: exp, Err: errors.New("doesn't match any property in target")}
+	}
+
+	change := &Change{Path: targetValue.Path()}
+	if targetValue.isCreated() {
+		change.Created = true
+	} else {
+		change.OldValue = interfaceOf(targetValue.getResolvedValue())
+	}
+
+	op, ok := value.(Op)
+	if !ok {
+		op = &setOp{value: value}
+	}
+	return op.apply(ctx, targetValue, change)
+}
+
+// interfaceOf returns the value v holds, nil for invalid or unexported value.
+// An optional wrapper gives the value it holds
+func interfaceOf(v reflect.Value) interface{} {
+	v = unwrapOptional(v)
+	if !v.IsValid() || !v.CanInterface() {
+		return nil
+	}
+	return v.Interface()
+}
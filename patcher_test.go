@@ -1,6 +1,13 @@
 package el_test
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,8 +21,14 @@ type Comment struct {
 	Date     time.Time
 }
 
+type Author struct {
+	Name string
+	Tags []string
+}
+
 type Blog struct {
 	Title      string
+	Author     Author
 	RoleState  map[string]uint
 	CommentIds []uint64
 	Comments   map[string]*Comment
@@ -27,7 +40,9 @@ func (b Blog) FirstComment() *Comment {
 
 func TestDoPatch(t *testing.T) {
 	assert := assert.New(t)
-	patcher := p.Patcher{}
+	patcher := p.Patcher{
+		Options: p.EvalOptions{Methods: p.NewMethodPolicy().AllowType(Blog{}, "FirstComment")},
+	}
 	b := &Blog{
 		Title:      "Blog title1",
 		CommentIds: []uint64{1, 3},
@@ -66,3 +81,946 @@ func TestDoPatch(t *testing.T) {
 	assert.Equal(uint(100), b.RoleState["100"])
 
 }
+
+func TestPatchDecodedJSON(t *testing.T) {
+	assert := assert.New(t)
+	patcher := p.Patcher{}
+	b := &Blog{
+		CommentIds: []uint64{1},
+		Comments:   map[string]*Comment{},
+	}
+
+	body := `{
+		"author": {"name": "ほん", "tags": ["go", "el"]},
+		"commentIds": [7, 8],
+		"comments[\"5\"]": {"nickName": "私", "content": "hi"}
+	}`
+	var req map[string]interface{}
+	d := json.NewDecoder(strings.NewReader(body))
+	d.UseNumber()
+	assert.NoError(d.Decode(&req))
+
+	ps := p.Patch{}
+	for path, value := range req {
+		ps[p.Expression(path)] = value
+	}
+	err := patcher.PatchIt(b, ps)
+	assert.NoError(err)
+	assert.Equal(Author{Name: "ほん", Tags: []string{"go", "el"}}, b.Author)
+	assert.Equal([]uint64{7, 8}, b.CommentIds)
+	assert.Equal("私", b.Comments["5"].NickName)
+	assert.Equal("hi", b.Comments["5"].Content)
+
+	err = patcher.PatchIt(b, p.Patch{"author": map[string]interface{}{"age": json.Number("3")}})
+	assert.Error(err)
+	err = patcher.PatchIt(b, p.Patch{"commentIds": []interface{}{json.Number("-1")}})
+	assert.Error(err)
+}
+
+type Draft struct {
+	Title   string
+	deleted bool
+}
+
+func (d *Draft) Delete() string {
+	d.deleted = true
+	return "deleted"
+}
+
+func (d *Draft) Self() *Draft {
+	return d
+}
+
+func (d *Draft) ELMethods() []string {
+	return []string{"Self"}
+}
+
+func TestMethodPolicy(t *testing.T) {
+	assert := assert.New(t)
+	d := &Draft{}
+	patcher := p.Patcher{}
+
+	err := patcher.PatchIt(d, p.Patch{"delete().title": "x"})
+	assert.Error(err)
+	var denied *p.MethodDeniedError
+	assert.True(errors.As(err, &denied))
+	assert.Equal("Delete", denied.Method)
+	assert.False(d.deleted)
+
+	// Exposed by ELMethods
+	err = patcher.PatchIt(d, p.Patch{"self().title": "x"})
+	assert.NoError(err)
+	assert.Equal("x", d.Title)
+
+	opts := &p.EvalOptions{Methods: p.NewMethodPolicy().AllowName("Delete")}
+	exp := p.Expression("Delete()")
+	v, err := exp.ExecuteWith(d, opts)
+	assert.NoError(err)
+	assert.Equal("deleted", v.String())
+	assert.True(d.deleted)
+
+	// Trusted expression can call anything
+	d.deleted = false
+	_, err = exp.Execute(d)
+	assert.NoError(err)
+	assert.True(d.deleted)
+}
+
+func TestPatchLimits(t *testing.T) {
+	assert := assert.New(t)
+	b := &Blog{CommentIds: []uint64{1}}
+	patcher := p.Patcher{}
+	var limit *p.LimitError
+
+	err := patcher.PatchIt(b, p.Patch{"commentIds[99999999]": uint64(1)})
+	assert.True(errors.As(err, &limit))
+	assert.Equal("slice growth", limit.Limit)
+	assert.Len(b.CommentIds, 1)
+
+	// Reading past the end is nil, setting it is limited for trusted
+	// expressions too, unless the limit is turned off
+	exp := p.Expression("CommentIds[50000000]")
+	v, err := exp.Execute(b)
+	assert.NoError(err)
+	assert.True(v.IsNil())
+	err = v.SetValue(uint64(2))
+	assert.True(errors.As(err, &limit))
+	assert.Equal("slice growth", limit.Limit)
+	assert.Len(b.CommentIds, 1)
+	exp = p.Expression("CommentIds[1500]")
+	v, err = exp.ExecuteWith(b, &p.EvalOptions{MaxSliceGrowth: p.Unlimited})
+	assert.NoError(err)
+	assert.NoError(v.SetValue(uint64(2)))
+	assert.Len(b.CommentIds, 1501)
+	b.CommentIds = []uint64{1}
+
+	err = patcher.PatchIt(b, p.Patch{p.Expression(strings.Repeat("(", 40) + "title" + strings.Repeat(")", 40)): "x"})
+	assert.True(errors.As(err, &limit))
+	assert.Equal("expression depth", limit.Limit)
+
+	err = patcher.PatchIt(b, p.Patch{p.Expression("title" + strings.Repeat(" ", 2000)): "x"})
+	assert.True(errors.As(err, &limit))
+	assert.Equal("expression length", limit.Limit)
+
+	patcher.Options.MaxPatchEntries = 1
+	err = patcher.PatchIt(b, p.Patch{"title": "x", "commentIds[0]": uint64(2)})
+	assert.True(errors.As(err, &limit))
+	assert.Equal("patch entries", limit.Limit)
+
+	patcher.Options = p.EvalOptions{
+		Methods:          p.NewMethodPolicy().AllowType(Blog{}),
+		MaxFunctionCalls: 1,
+	}
+	b.Comments = map[string]*Comment{"0": {}}
+	err = patcher.PatchIt(b, p.Patch{"firstComment().content": "x"})
+	assert.NoError(err)
+	err = patcher.PatchIt(b, p.Patch{"firstComment() ? firstComment().content : title": "x"})
+	assert.True(errors.As(err, &limit))
+	assert.Equal("function calls", limit.Limit)
+
+	patcher.Options = p.EvalOptions{MaxSliceGrowth: p.Unlimited}
+	err = patcher.PatchIt(b, p.Patch{"commentIds[1999]": uint64(1), "title": "x"})
+	assert.NoError(err)
+	assert.Len(b.CommentIds, 2000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	patcher.Options.Context = ctx
+	err = patcher.PatchIt(b, p.Patch{"title": "y"})
+	assert.True(errors.Is(err, context.Canceled))
+	assert.Equal("x", b.Title)
+}
+
+func TestPatchItWithChanges(t *testing.T) {
+	assert := assert.New(t)
+	patcher := p.Patcher{}
+	b := &Blog{
+		Title:      "Blog title1",
+		CommentIds: []uint64{1},
+		Comments: map[string]*Comment{
+			"1": {NickName: "u1"},
+		},
+	}
+	changes, err := patcher.PatchItWithChanges(b, p.Patch{
+		"title":                            "title B",
+		"commentIds[1]":                    uint64(4),
+		"comments[commentIds[0]].nickName": "私",
+		`roleState["admin"]`:               uint(1),
+	})
+	assert.NoError(err)
+	assert.Equal(p.ChangeSet{
+		{Path: "CommentIds[1]", NewValue: uint64(4), Created: true},
+		{Path: `Comments["1"].NickName`, OldValue: "u1", NewValue: "私"},
+		{Path: `RoleState["admin"]`, NewValue: uint(1), Created: true},
+		{Path: "Title", OldValue: "Blog title1", NewValue: "title B"},
+	}, changes)
+
+	data, err := json.Marshal(changes[1])
+	assert.NoError(err)
+	assert.JSONEq(`{"path": "Comments[\"1\"].NickName", "oldValue": "u1", "newValue": "私", "created": false}`, string(data))
+
+	// An entry is created when any item on its path is
+	s := &Sheet{Rows: map[string]Row{"a": {Cells: [3]int{1}}}}
+	changes, err = patcher.PatchItWithChanges(s, p.Patch{
+		`rows["a"].cells[0]`: 2,
+		`rows["z"].cells[1]`: 3,
+	})
+	assert.NoError(err)
+	assert.Equal(p.ChangeSet{
+		{Path: `Rows["a"].Cells[0]`, OldValue: 1, NewValue: 2},
+		{Path: `Rows["z"].Cells[1]`, NewValue: 3, Created: true},
+	}, changes)
+
+	doc := map[string]interface{}{"list": []interface{}{}}
+	changes, err = patcher.PatchItWithChanges(doc, p.Patch{"list[1].name": "x"})
+	assert.NoError(err)
+	assert.Equal(p.ChangeSet{{Path: `["list"][1]["name"]`, NewValue: "x", Created: true}}, changes)
+}
+
+func TestDryRun(t *testing.T) {
+	assert := assert.New(t)
+	patcher := p.Patcher{}
+	b := &Blog{
+		Title:      "Blog title1",
+		CommentIds: []uint64{1},
+		Comments: map[string]*Comment{
+			"1": {NickName: "u1"},
+		},
+	}
+	changes, err := patcher.DryRun(b, p.Patch{
+		"title":                            "title B",
+		"commentIds[3]":                    json.Number("4"),
+		"comments[commentIds[0]].nickName": "私",
+		`roleState["admin"]`:               uint(1),
+	})
+	assert.NoError(err)
+	assert.Equal(p.ChangeSet{
+		{Path: "CommentIds[3]", NewValue: uint64(4), Created: true},
+		{Path: `Comments["1"].NickName`, OldValue: "u1", NewValue: "私"},
+		{Path: `RoleState["admin"]`, NewValue: uint(1), Created: true},
+		{Path: "Title", OldValue: "Blog title1", NewValue: "title B"},
+	}, changes)
+	assert.Equal("Blog title1", b.Title)
+	assert.Equal([]uint64{1}, b.CommentIds)
+	assert.Equal("u1", b.Comments["1"].NickName)
+	assert.Nil(b.RoleState)
+
+	changes, err = patcher.DryRun(b, p.Patch{
+		"title":          1,
+		"commentIds[-1]": uint64(1),
+		"comments[2]":    &Comment{},
+		"missing":        "x",
+	})
+	var errs p.PatchErrors
+	assert.True(errors.As(err, &errs))
+	assert.Len(errs, 3)
+	assert.Equal(p.ChangeSet{{Path: `Comments["2"]`, NewValue: Comment{}, Created: true}}, changes)
+	_, ok := b.Comments["2"]
+	assert.False(ok)
+}
+
+func TestSliceOps(t *testing.T) {
+	assert := assert.New(t)
+	patcher := p.Patcher{}
+	b := &Blog{CommentIds: []uint64{1, 2, 3}}
+
+	changes, err := patcher.PatchItWithChanges(b, p.Patch{"commentIds[+]": uint64(4)})
+	assert.NoError(err)
+	assert.Equal([]uint64{1, 2, 3, 4}, b.CommentIds)
+	assert.Equal(p.ChangeSet{{Path: "CommentIds[3]", NewValue: uint64(4), Created: true}}, changes)
+
+	err = patcher.PatchIt(b, p.Patch{"commentIds[-]": json.Number("5")})
+	assert.NoError(err)
+	assert.Equal([]uint64{1, 2, 3, 4, 5}, b.CommentIds)
+
+	changes, err = patcher.PatchItWithChanges(b, p.Patch{"commentIds[1]": p.Insert(uint64(9))})
+	assert.NoError(err)
+	assert.Equal([]uint64{1, 9, 2, 3, 4, 5}, b.CommentIds)
+	assert.Equal(p.ChangeSet{{Path: "CommentIds[1]", NewValue: uint64(9), Created: true}}, changes)
+
+	changes, err = patcher.PatchItWithChanges(b, p.Patch{"commentIds[0]": p.Remove()})
+	assert.NoError(err)
+	assert.Equal([]uint64{9, 2, 3, 4, 5}, b.CommentIds)
+	assert.Equal(p.ChangeSet{{Path: "CommentIds[0]", OldValue: uint64(1)}}, changes)
+
+	_, err = patcher.DryRun(b, p.Patch{"commentIds[4]": p.Remove(), "commentIds[5]": p.Insert(uint64(6))})
+	assert.NoError(err)
+	assert.Equal([]uint64{9, 2, 3, 4, 5}, b.CommentIds)
+
+	err = patcher.PatchIt(b, p.Patch{"commentIds[9]": p.Remove()})
+	assert.Error(err)
+	err = patcher.PatchIt(b, p.Patch{"title[+]": "x"})
+	assert.Error(err)
+
+	exp := p.Expression("CommentIds")
+	v, err := exp.Execute(b)
+	assert.NoError(err)
+	assert.NoError(v.Append(6))
+	assert.Equal([]uint64{9, 2, 3, 4, 5, 6}, b.CommentIds)
+
+	exp = p.Expression("CommentIds[1]")
+	v, err = exp.Execute(b)
+	assert.NoError(err)
+	assert.NoError(v.Remove())
+	assert.Equal([]uint64{9, 3, 4, 5, 6}, b.CommentIds)
+	assert.NoError(v.Insert(2))
+	assert.Equal([]uint64{9, 2, 3, 4, 5, 6}, b.CommentIds)
+}
+
+type Stats struct {
+	Views   int8
+	Likes   uint
+	Score   float32
+	Best    string
+	Updated time.Time
+	Counts  map[string]int
+	Tags    []string
+}
+
+func TestUpdateOps(t *testing.T) {
+	assert := assert.New(t)
+	patcher := p.Patcher{}
+	s := &Stats{Views: 100, Likes: 2, Score: 1.5, Best: "m", Tags: []string{"a", "b", "a"}, Counts: map[string]int{"x": 1}}
+
+	err := patcher.PatchIt(s, p.Patch{
+		"views":       p.Inc(20),
+		"likes":       p.Mul(json.Number("3")),
+		"score":       p.Inc(0.25),
+		`counts["x"]`: p.Inc(2),
+		`counts["y"]`: p.Inc(int64(5)),
+		"best":        p.Max("z"),
+		"tags":        p.Pull("a"),
+		"updated":     p.Max("2020-01-02T00:00:00Z"),
+	})
+	assert.NoError(err)
+	assert.Equal(int8(120), s.Views)
+	assert.Equal(uint(6), s.Likes)
+	assert.Equal(float32(1.75), s.Score)
+	assert.Equal(map[string]int{"x": 3, "y": 5}, s.Counts)
+	assert.Equal("z", s.Best)
+	assert.Equal([]string{"b"}, s.Tags)
+	assert.Equal(2020, s.Updated.Year())
+
+	err = patcher.PatchIt(s, p.Patch{"views": p.Inc(8)})
+	assert.Error(err)
+	assert.Equal(int8(120), s.Views)
+	err = patcher.PatchIt(s, p.Patch{"likes": p.Inc(0.5)})
+	assert.Error(err)
+	err = patcher.PatchIt(s, p.Patch{"best": p.Inc(1)})
+	assert.Error(err)
+
+	changes, err := patcher.PatchItWithChanges(s, p.Patch{"best": p.Min("zz"), "tags": p.AddToSet("b", "c")})
+	assert.NoError(err)
+	assert.Equal("z", s.Best)
+	assert.Equal([]string{"b", "c"}, s.Tags)
+	assert.Equal(p.ChangeSet{
+		{Path: "Best", OldValue: "z", NewValue: "z"},
+		{Path: "Tags", OldValue: []string{"b"}, NewValue: []string{"b", "c"}},
+	}, changes)
+
+	changes, err = patcher.PatchItWithChanges(s, p.Patch{`counts["x"]`: p.Rename(`counts["z"]`), "score": p.Unset()})
+	assert.NoError(err)
+	assert.Equal(map[string]int{"y": 5, "z": 3}, s.Counts)
+	assert.Equal(float32(0), s.Score)
+	assert.Equal(p.ChangeSet{
+		{Path: `Counts["x"]`, OldValue: 3},
+		{Path: `Counts["z"]`, NewValue: 3, Created: true},
+		{Path: "Score", OldValue: float32(1.75)},
+	}, changes)
+
+	var doc map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(`{
+		"$inc": {"views": -20},
+		"$push": {"tags": {"$each": ["d", "e"]}},
+		"$unset": {"counts[\"y\"]": ""},
+		"$set": {"best": "b"}
+	}`), &doc))
+	patch, err := p.FromUpdate(doc)
+	assert.NoError(err)
+	_, err = patcher.DryRun(s, patch)
+	assert.NoError(err)
+	assert.Equal(int8(120), s.Views)
+	assert.Equal([]string{"b", "c"}, s.Tags)
+	assert.NoError(patcher.PatchIt(s, patch))
+	assert.Equal(int8(100), s.Views)
+	assert.Equal([]string{"b", "c", "d", "e"}, s.Tags)
+	assert.Equal(map[string]int{"z": 3}, s.Counts)
+	assert.Equal("b", s.Best)
+
+	_, err = p.FromUpdate(map[string]interface{}{"$inc": map[string]interface{}{"views": 1}, "$set": map[string]interface{}{"views": 1}})
+	assert.Error(err)
+	_, err = p.FromUpdate(map[string]interface{}{"$pop": map[string]interface{}{"tags": 1}})
+	assert.Error(err)
+}
+
+func TestPatchRef(t *testing.T) {
+	assert := assert.New(t)
+	patcher := p.Patcher{}
+	b := &Blog{
+		Title:    "title",
+		Author:   Author{Name: "author"},
+		Comments: map[string]*Comment{"0": {NickName: "tester", Content: "hi"}},
+	}
+
+	changes, err := patcher.PatchItWithChanges(b, p.Patch{
+		"author.name":            p.Ref(`Comments["0"].NickName`),
+		`comments["0"].nickName`: p.Ref("Title"),
+		"title":                  p.Ref("Author.Name"),
+	})
+	assert.NoError(err)
+	assert.Equal("tester", b.Author.Name)
+	assert.Equal("title", b.Comments["0"].NickName)
+	assert.Equal("author", b.Title)
+	assert.Len(changes, 3)
+
+	// Referred pointers are copied, not shared
+	assert.NoError(patcher.PatchIt(b, p.Patch{`comments["1"]`: p.Ref(`Comments["0"]`)}))
+	assert.Equal(*b.Comments["0"], *b.Comments["1"])
+	assert.False(b.Comments["0"] == b.Comments["1"])
+
+	source := &Blog{Title: "other"}
+	assert.NoError(patcher.PatchIt(b, p.Patch{"title": p.RefIn(source, "Title")}))
+	assert.Equal("other", b.Title)
+
+	err = patcher.PatchIt(b, p.Patch{"title": p.Ref(`Comments["9"].NickName`)})
+	assert.Error(err)
+
+	// A bad reference fails the patch before anything is written
+	b.CommentIds = []uint64{1, 2}
+	err = patcher.PatchIt(b, p.Patch{"commentIds[0]": uint64(100), "title": p.Ref("Nope")})
+	assert.Error(err)
+	assert.Equal([]uint64{1, 2}, b.CommentIds)
+
+	// Referred slices and maps are copied, later writes don't change them
+	s := &Sheet{Rows: map[string]Row{"a": {Tags: []string{"x", "y"}}}}
+	assert.NoError(patcher.PatchIt(s, p.Patch{
+		`rows["a"].tags[0]`: "z",
+		`rows["b"].tags`:    p.Ref(`Rows["a"].Tags`),
+		`rows["c"]`:         p.Ref(`Rows["a"]`),
+	}))
+	assert.Equal([]string{"z", "y"}, s.Rows["a"].Tags)
+	assert.Equal([]string{"x", "y"}, s.Rows["b"].Tags)
+	assert.Equal([]string{"x", "y"}, s.Rows["c"].Tags)
+	_, err = patcher.DryRun(b, p.Patch{"title": p.Ref("Missing"), "author.name": p.Ref("Title")})
+	var errs p.PatchErrors
+	assert.True(errors.As(err, &errs))
+	assert.Len(errs, 1)
+}
+
+type Versioned struct {
+	Version int
+	Title   string
+}
+
+func TestPatchPreconditions(t *testing.T) {
+	assert := assert.New(t)
+	patcher := p.Patcher{}
+	v := &Versioned{Version: 7, Title: "old"}
+
+	changes, err := patcher.PatchIf(v, p.Patch{"title": "new", "version": p.Inc(1)}, "Version == 7")
+	assert.NoError(err)
+	assert.Len(changes, 2)
+	assert.Equal(Versioned{Version: 8, Title: "new"}, *v)
+
+	_, err = patcher.PatchIf(v, p.Patch{"title": "newer"}, "Version == 7")
+	var precondErr *p.PreconditionError
+	assert.True(errors.As(err, &precondErr))
+	assert.Equal(p.Expression("Version == 7"), precondErr.Condition)
+	assert.Equal("new", v.Title)
+
+	_, err = patcher.PatchIf(v, p.Patch{"title": "newer"}, "Version ==")
+	assert.True(errors.As(err, &precondErr))
+	assert.Error(precondErr.Err)
+
+	err = patcher.PatchIt(v, p.Patch{"version": p.Test(json.Number("7")), "title": "newer"})
+	assert.True(errors.As(err, &precondErr))
+	assert.Equal("new", v.Title)
+
+	changes, err = patcher.PatchItWithChanges(v, p.Patch{"version": p.Test(8.0), "title": "newer"})
+	assert.NoError(err)
+	assert.Equal(p.ChangeSet{{Path: "Title", OldValue: "new", NewValue: "newer"}}, changes)
+
+	_, err = patcher.DryRun(v, p.Patch{"version": p.Test(1), "title": 1})
+	var errs p.PatchErrors
+	assert.True(errors.As(err, &errs))
+	assert.Len(errs, 2)
+	assert.True(errors.As(errs[1], &precondErr))
+}
+
+func TestIdentifierCase(t *testing.T) {
+	assert := assert.New(t)
+	patcher := p.Patcher{Options: p.EvalOptions{Methods: p.NewMethodPolicy().AllowType(Blog{}, "FirstComment")}}
+	b := &Blog{
+		RoleState: map[string]uint{"admin": 1},
+		Comments:  map[string]*Comment{"0": {NickName: "tester"}},
+	}
+
+	changes, err := patcher.PatchItWithChanges(b, p.Patch{"roleState.admin": uint(2), "TITLE": "t", "firstComment.content": "c"})
+	assert.NoError(err)
+	assert.Equal(map[string]uint{"admin": 2}, b.RoleState)
+	assert.Equal("t", b.Title)
+	assert.Equal("c", b.Comments["0"].Content)
+	assert.Equal("FirstComment().Content", changes[1].Path)
+	assert.Equal(`RoleState["admin"]`, changes[2].Path)
+
+	err = patcher.PatchIt(b, p.Patch{"roleState.Admin": uint(3)})
+	assert.Error(err)
+	assert.Contains(err.Error(), "did you mean 'admin'")
+	assert.Equal(map[string]uint{"admin": 2}, b.RoleState)
+
+	// Bracket keys are exact, so a key differing in case can still be added
+	assert.NoError(patcher.PatchIt(b, p.Patch{`roleState["Admin"]`: uint(3)}))
+	assert.Equal(map[string]uint{"admin": 2, "Admin": 3}, b.RoleState)
+
+	err = patcher.PatchIt(b, p.Patch{"titel": "x"})
+	assert.Error(err)
+	assert.Contains(err.Error(), "Can't find field 'titel'")
+
+	assert.Equal("roleState", p.Expression("roleState.admin").FirstPart())
+}
+
+type Account struct {
+	ID    int
+	Email string `json:"mail"`
+}
+
+func (a *Account) Id() string {
+	return fmt.Sprintf("account-%d", a.ID)
+}
+
+func (a *Account) Mail() string {
+	return "hidden"
+}
+
+func TestFieldAndMethodCase(t *testing.T) {
+	assert := assert.New(t)
+	a := &Account{ID: 7, Email: "a@b.c"}
+
+	// Exact names win, then fields ignoring case before methods
+	for exp, expected := range map[p.Expression]interface{}{
+		"ID":   7,
+		"Id":   "account-7",
+		"mail": "a@b.c",
+		"id":   7,
+		"MAIL": "hidden",
+	} {
+		v, err := exp.Execute(a)
+		assert.NoError(err, string(exp))
+		assert.Equal(expected, v.Interface(), string(exp))
+	}
+
+	patcher := p.Patcher{}
+	assert.NoError(patcher.PatchIt(a, p.Patch{"ID": 9, "mail": "x@y.z"}))
+	assert.Equal(&Account{ID: 9, Email: "x@y.z"}, a)
+	assert.NoError(patcher.PatchIt(a, p.Patch{"id": 3}))
+	assert.Equal(3, a.ID)
+}
+
+type Base struct {
+	ID      int64
+	Created time.Time
+}
+
+type Audit struct {
+	ID   int64
+	By   string
+	Note string
+}
+
+type Page struct {
+	*Base
+	*Audit
+	Title string
+}
+
+type Label struct {
+	Name string
+	NAME string
+}
+
+func TestEmbeddedFields(t *testing.T) {
+	assert := assert.New(t)
+	patcher := p.Patcher{}
+	page := &Page{Title: "page"}
+
+	// Reading through nil embedded pointers is nil, patching allocates them
+	exp := p.Expression("By")
+	v, err := exp.Execute(page)
+	assert.NoError(err)
+	assert.True(v.IsNil())
+	assert.Nil(page.Audit)
+
+	// also when the embedded struct is named
+	for _, expr := range []string{"Audit.By", "base.id"} {
+		exp = p.Expression(expr)
+		v, err = exp.Execute(page)
+		assert.NoError(err, expr)
+		assert.True(v.IsNil(), expr)
+	}
+	exp = p.Expression("Base.Missing")
+	_, err = exp.Execute(page)
+	assert.Error(err)
+	assert.Nil(page.Audit)
+	assert.Nil(page.Base)
+
+	_, err = patcher.DryRun(page, p.Patch{"by": "x", "base.id": 1})
+	assert.NoError(err)
+	assert.Nil(page.Audit)
+	assert.Nil(page.Base)
+
+	assert.NoError(patcher.PatchIt(page, p.Patch{"by": "x", "base.id": 1, "audit.id": 2}))
+	assert.Equal("x", page.By)
+	assert.Equal(int64(1), page.Base.ID)
+	assert.Equal(int64(2), page.Audit.ID)
+
+	err = patcher.PatchIt(page, p.Patch{"id": 3})
+	assert.Error(err)
+	assert.Contains(err.Error(), "Field 'id' is ambiguous in type el_test.Page, name its embedded struct: 'Base.ID' or 'Audit.ID'")
+
+	label := &Label{}
+	err = patcher.PatchIt(label, p.Patch{"name": "x"})
+	assert.Error(err)
+	assert.Contains(err.Error(), "Field 'name' is ambiguous in type el_test.Label, it matches 'Name' and 'NAME' ignoring case, use the exact name")
+	assert.NoError(patcher.PatchIt(label, p.Patch{"NAME": "x"}))
+	assert.Equal("x", label.NAME)
+
+	assert.NoError(patcher.PatchIt(page, p.Patch{"note": "n", "created": "2020-01-02T00:00:00Z"}))
+	assert.Equal("n", page.Note)
+	assert.Equal(2020, page.Created.Year())
+
+	var body map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(`{"page": {"title": "t", "by": "y"}}`), &body))
+	holder := &struct{ Page Page }{}
+	assert.NoError(patcher.PatchIt(holder, p.Patch{"page": body["page"]}))
+	assert.Equal("y", holder.Page.By)
+}
+
+type Row struct {
+	Cells [3]int
+	Tags  []string
+	Notes map[string]Comment
+}
+
+type Sheet struct {
+	Rows     map[string]Row
+	Comments map[string]Comment
+}
+
+func TestPatchMapStructValues(t *testing.T) {
+	assert := assert.New(t)
+	patcher := p.Patcher{}
+	s := &Sheet{
+		Rows:     map[string]Row{"a": {Notes: map[string]Comment{"n": {NickName: "x"}}}},
+		Comments: map[string]Comment{"3": {NickName: "tester", Content: "hi"}},
+	}
+
+	changes, err := patcher.PatchItWithChanges(s, p.Patch{
+		`comments["3"].nickName`:       "ほん",
+		`rows["a"].cells[1]`:           7,
+		`rows["a"].tags[+]`:            "t",
+		`rows["a"].notes["n"].content`: "c",
+	})
+	assert.NoError(err)
+	assert.Equal(Comment{NickName: "ほん", Content: "hi"}, s.Comments["3"])
+	assert.Equal([3]int{0, 7, 0}, s.Rows["a"].Cells)
+	assert.Equal([]string{"t"}, s.Rows["a"].Tags)
+	assert.Equal(Comment{NickName: "x", Content: "c"}, s.Rows["a"].Notes["n"])
+	assert.Equal(`Rows["a"].Cells[1]`, changes[1].Path)
+
+	// Nothing is stored back when the write fails or for dry run
+	err = patcher.PatchIt(s, p.Patch{`rows["a"].cells[1]`: "x"})
+	assert.Error(err)
+	_, err = patcher.DryRun(s, p.Patch{`comments["3"].content`: "dry"})
+	assert.NoError(err)
+	assert.Equal([3]int{0, 7, 0}, s.Rows["a"].Cells)
+	assert.Equal("hi", s.Comments["3"].Content)
+
+	assert.NoError(patcher.PatchIt(s, p.Patch{`rows["a"].tags[0]`: p.Remove(), `comments["3"].content`: p.Unset()}))
+	assert.Empty(s.Rows["a"].Tags)
+	assert.Equal("", s.Comments["3"].Content)
+
+	exp := p.Expression(`Comments["3"].NickName`)
+	v, err := exp.Execute(s)
+	assert.NoError(err)
+	assert.NoError(v.SetValue("set"))
+	assert.Equal("set", s.Comments["3"].NickName)
+}
+
+func TestPatchDynamicDocument(t *testing.T) {
+	assert := assert.New(t)
+	patcher := p.Patcher{}
+	var doc map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(`{
+		"title": "t",
+		"tags": ["a", "b"],
+		"comments": [{"nickName": "x", "likes": [1]}],
+		"meta": {"views": 1}
+	}`), &doc))
+
+	changes, err := patcher.PatchItWithChanges(doc, p.Patch{
+		"tags[+]":              "c",
+		"tags[0]":              "A",
+		"comments[0].nickName": "y",
+		"comments[0].likes[+]": 2,
+		"comments[1].nickName": "new",
+		"meta.views":           p.Inc(1),
+		"meta.author.name":     "ほん",
+		`meta."list"[0]`:       true,
+		`extra["k"]`:           "v",
+	})
+	assert.NoError(err)
+	assert.Equal([]interface{}{"A", "b", "c"}, doc["tags"])
+	assert.Equal([]interface{}{
+		map[string]interface{}{"nickName": "y", "likes": []interface{}{float64(1), 2}},
+		map[string]interface{}{"nickName": "new"},
+	}, doc["comments"])
+	assert.Equal(map[string]interface{}{
+		"views":  float64(2),
+		"author": map[string]interface{}{"name": "ほん"},
+		"list":   []interface{}{true},
+	}, doc["meta"])
+	assert.Equal(map[string]interface{}{"k": "v"}, doc["extra"])
+	assert.Len(changes, 9)
+
+	exp := p.Expression("comments[1].nickName")
+	v, err := exp.Execute(doc)
+	assert.NoError(err)
+	assert.Equal("new", v.Interface())
+
+	// Reading and dry run never create anything
+	exp = p.Expression("missing.key")
+	_, err = exp.Execute(doc)
+	assert.Error(err)
+	_, err = patcher.DryRun(doc, p.Patch{"missing.key": 1, "tags[0]": p.Remove()})
+	assert.NoError(err)
+	assert.NotContains(doc, "missing")
+	assert.Len(doc["tags"], 3)
+
+	assert.NoError(patcher.PatchIt(doc, p.Patch{"tags[0]": p.Remove(), "meta.author": p.Unset(), "comments[0].likes": p.Pull(json.Number("1"))}))
+	assert.Equal([]interface{}{"b", "c"}, doc["tags"])
+	assert.NotContains(doc["meta"], "author")
+	assert.Equal([]interface{}{2}, doc["comments"].([]interface{})[0].(map[string]interface{})["likes"])
+}
+
+type Board struct {
+	Matrix [3][3]int
+	Grids  map[string][2][2]int
+	Rows   [][]int
+}
+
+func (b Board) Diagonal() []int {
+	return []int{b.Matrix[0][0], b.Matrix[1][1], b.Matrix[2][2]}
+}
+
+func TestArrays(t *testing.T) {
+	assert := assert.New(t)
+	patcher := p.Patcher{Options: p.EvalOptions{Methods: p.AllowAllMethods()}}
+	b := &Board{Grids: map[string][2][2]int{"a": {}}, Rows: [][]int{{1}}}
+
+	changes, err := patcher.PatchItWithChanges(b, p.Patch{
+		"matrix[1][2]":     5,
+		"matrix[1][1]":     4,
+		`grids["a"][1][0]`: 7,
+		"rows[0][+]":       2,
+		"rows[1][0]":       3,
+	})
+	assert.NoError(err)
+	assert.Equal([3][3]int{{}, {0, 4, 5}, {}}, b.Matrix)
+	assert.Equal([2][2]int{{}, {7, 0}}, b.Grids["a"])
+	assert.Equal([][]int{{1, 2}, {3}}, b.Rows)
+	assert.Equal(`Grids["a"][1][0]`, changes[0].Path)
+	assert.Equal("Matrix[1][2]", changes[2].Path)
+
+	exp := p.Expression("Diagonal()[1]")
+	v, err := exp.Execute(b)
+	assert.NoError(err)
+	assert.Equal(4, v.Interface())
+
+	exp = p.Expression("Matrix[2]?[0]")
+	v, err = exp.Execute(b)
+	assert.NoError(err)
+	assert.Equal(0, v.Interface())
+
+	err = patcher.PatchIt(b, p.Patch{"matrix[1][3]": 1})
+	assert.Error(err)
+	assert.Contains(err.Error(), "array [3]int has fixed length 3 (variable matrix[1][3])")
+	err = patcher.PatchIt(b, p.Patch{"matrix[rows[1][0]][0]": 1})
+	assert.Error(err)
+	assert.Contains(err.Error(), "Index out of range: 3, array [3][3]int has fixed length 3 (variable matrix[rows[1][0]][0])")
+	err = patcher.PatchIt(b, p.Patch{`grids["a"][2][0]`: 1})
+	assert.Error(err)
+	assert.Equal([2][2]int{{}, {7, 0}}, b.Grids["a"])
+}
+
+type Endpoint struct {
+	Host string
+}
+
+// Services keeps its entries in a sync.Map, which reflection can't navigate
+type Services struct {
+	entries sync.Map
+}
+
+func (r *Services) ELGet(key *p.Value) (*p.Value, error) {
+	if !key.IsString() {
+		return nil, errors.New("Services key must be a string")
+	}
+	v, ok := r.entries.Load(key.String())
+	if !ok {
+		return nil, nil
+	}
+	return p.AsValue(v), nil
+}
+
+func (r *Services) ELSet(key, val *p.Value) error {
+	if val.IsNil() {
+		r.entries.Delete(key.String())
+		return nil
+	}
+	r.entries.Store(key.String(), val.Interface())
+	return nil
+}
+
+func (r *Services) Len() int {
+	n := 0
+	r.entries.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+type Service struct {
+	Name     string
+	Services *Services
+}
+
+func TestAccessor(t *testing.T) {
+	assert := assert.New(t)
+	s := &Service{Services: &Services{}}
+	s.Services.entries.Store("db", &Endpoint{Host: "h1"})
+	s.Services.entries.Store("cache", "c1")
+
+	for exp, expected := range map[p.Expression]interface{}{
+		"Services.db.Host":      "h1",
+		`Services["db"].Host`:   "h1",
+		"Services.cache":        "c1",
+		"Services.none?.Host":   nil,
+		`Services["none"] ?? 1`: 1,
+	} {
+		v, err := exp.Execute(s)
+		assert.NoError(err, string(exp))
+		assert.Equal(expected, v.Interface(), string(exp))
+	}
+	exp := p.Expression("Services[1]")
+	_, err := exp.Execute(s)
+	assert.Error(err)
+	assert.Contains(err.Error(), "Services key must be a string")
+
+	patcher := p.Patcher{}
+	changes, err := patcher.DryRun(s, p.Patch{"services.cache": "c2"})
+	assert.NoError(err)
+	assert.Equal("Services.cache", changes[0].Path)
+	v, _ := s.Services.entries.Load("cache")
+	assert.Equal("c1", v)
+
+	changes, err = patcher.PatchItWithChanges(s, p.Patch{
+		"services.cache":   p.Unset(),
+		"services.db.host": "h2",
+		`services["mq"]`:   &Endpoint{Host: "h3"},
+	})
+	assert.NoError(err)
+	assert.Len(changes, 3)
+	assert.Equal(`Services["mq"]`, changes[2].Path)
+	assert.True(changes[2].Created)
+	_, ok := s.Services.entries.Load("cache")
+	assert.False(ok)
+	v, _ = s.Services.entries.Load("db")
+	assert.Equal("h2", v.(*Endpoint).Host)
+	v, _ = s.Services.entries.Load("mq")
+	assert.Equal("h3", v.(*Endpoint).Host)
+
+	// Keys named like methods are keys, methods are reached by calls only
+	assert.NoError(patcher.PatchIt(s, p.Patch{"services.len": "l1"}))
+	v, _ = s.Services.entries.Load("len")
+	assert.Equal("l1", v)
+	exp = p.Expression("Services.len")
+	value, err := exp.Execute(s)
+	assert.NoError(err)
+	assert.Equal("l1", value.Interface())
+	exp = p.Expression("Services.Len()")
+	value, err = exp.Execute(s)
+	assert.NoError(err)
+	assert.Equal(3, value.Interface())
+
+	err = patcher.PatchIt(s, p.Patch{"services.none.host": "h4"})
+	assert.Error(err)
+}
+
+type Maybe struct {
+	V     int
+	Valid bool
+}
+
+type Member struct {
+	Nickname sql.NullString
+	Age      sql.NullInt64
+	Joined   sql.NullTime
+	Scores   map[string]sql.NullFloat64
+	Level    Maybe
+}
+
+func TestPatchOptional(t *testing.T) {
+	assert := assert.New(t)
+	p.RegisterOptional(Maybe{}, p.ValidField("V"))
+	m := &Member{
+		Nickname: sql.NullString{String: "nick", Valid: true},
+		Scores:   map[string]sql.NullFloat64{"a": {}},
+		Level:    Maybe{V: 2, Valid: true},
+	}
+
+	for exp, expected := range map[p.Expression]interface{}{
+		"Nickname":           "nick",
+		"Age":                nil,
+		"Age ?? 18":          18,
+		`Nickname == "nick"`: true,
+		`Scores["a"]`:        nil,
+		"Level":              2,
+		"Nickname.Valid":     true,
+	} {
+		v, err := exp.Execute(m)
+		assert.NoError(err, string(exp))
+		assert.Equal(expected, v.Interface(), string(exp))
+	}
+
+	patcher := p.Patcher{}
+	changes, err := patcher.PatchItWithChanges(m, p.Patch{
+		"nickname":    nil,
+		"age":         json.Number("30"),
+		"joined":      "2020-01-02T00:00:00Z",
+		`scores["a"]`: 1.5,
+		`scores["b"]`: p.Inc(2),
+		"level":       p.Unset(),
+	})
+	assert.NoError(err)
+	assert.Equal(sql.NullString{}, m.Nickname)
+	assert.Equal(sql.NullInt64{Int64: 30, Valid: true}, m.Age)
+	assert.Equal(sql.NullTime{Time: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), Valid: true}, m.Joined)
+	assert.Equal(map[string]sql.NullFloat64{"a": {Float64: 1.5, Valid: true}, "b": {Float64: 2, Valid: true}}, m.Scores)
+	assert.Equal(Maybe{}, m.Level)
+	assert.Equal(int64(30), changes[0].NewValue)
+	assert.Equal(nil, changes[0].OldValue)
+	assert.Equal(2, changes[2].OldValue)
+	assert.Equal(nil, changes[2].NewValue)
+	assert.Equal("nick", changes[3].OldValue)
+	assert.Equal(nil, changes[3].NewValue)
+
+	err = patcher.PatchIt(m, p.Patch{"age": p.Inc(1), "level": p.Inc(1)})
+	assert.NoError(err)
+	assert.Equal(sql.NullInt64{Int64: 31, Valid: true}, m.Age)
+	assert.Equal(Maybe{V: 1, Valid: true}, m.Level)
+
+	err = patcher.PatchIt(m, p.Patch{"age": "thirty"})
+	assert.Error(err)
+	assert.Equal(sql.NullInt64{Int64: 31, Valid: true}, m.Age)
+}
@@ -3,6 +3,7 @@ package el
 import (
 	"encoding/json"
 	"fmt"
+	"math/big"
 	"reflect"
 	"strconv"
 	"strings"
@@ -11,14 +12,81 @@ import (
 // NumberType patch api use this type to deserialize JSON request in Golang
 var NumberType = reflect.TypeOf(json.Number(""))
 
+var (
+	bigIntType   = reflect.TypeOf(big.Int{})
+	bigFloatType = reflect.TypeOf(big.Float{})
+)
+
+// maxNumberExp is the largest exponent accepted in a json.Number
+const maxNumberExp = 1000
+
 type Value struct {
 	val       reflect.Value
 	keySetter *KeySetter
+	token     *Token // segment this value is resolved from, if any
+	path      string
+	backs     []writeBack   // copies of map items to store back after writing
+	held      *writeBack    // copy of the value itself, stored back after writing into it
+	slot      reflect.Value // settable interface or optional wrapper the value is held by, if any
+	created   bool          // a map key was added or a slice grown on the way to the value
 }
 
 type KeySetter struct {
-	prev *Value
+	prev      *Value
+	key       reflect.Value
+	created   bool // the key is missing in map, or the slice was grown for it
+	maxGrowth int  // EvalOptions.MaxSliceGrowth applied when setValue grows the slice
+
+	accessor Accessor // prev is navigated by its Accessor, key is passed to it
+}
+
+// Accessor can be implemented by types wrapping their data, e.g. lazy loaded
+// entities or registries backed by sync.Map, which reflection can't navigate.
+// Field and index segments on such a type are resolved by ELGet, setting
+// them calls ELSet. A nil value from ELGet is a missing item
+type Accessor interface {
+	ELGet(key *Value) (*Value, error)
+	ELSet(key, val *Value) error
+}
+
+// writeBack stores an item, which is navigated into for writing but can't
+// be changed in place, back where it's kept: a map item, a value held by an
+// interface, or an item created for a missing one
+type writeBack struct {
+	m    reflect.Value // map the item is kept in, with key
 	key  reflect.Value
+	slot reflect.Value // or a settable place the item is kept in
+	item reflect.Value
+}
+
+// finish is deferred by methods writing into v: a panic becomes *err,
+// otherwise the items v is written through are stored back after a write
+func (v *Value) finish(err *error, dryRun bool) {
+	if r := recover(); r != nil {
+		*err = recoveredError(r, v.token)
+	} else if *err == nil && !dryRun {
+		v.storeBack()
+	}
+}
+
+// storeBack stores the items v was written through, the innermost first
+func (v *Value) storeBack() {
+	for i := len(v.backs) - 1; i >= 0; i-- {
+		v.backs[i].store()
+	}
+}
+
+func (b *writeBack) store() {
+	switch {
+	case b.slot.IsValid():
+		b.slot.Set(b.item)
+	case b.m.IsNil():
+		// Like setValue, a nil map is created when it's settable
+		b.m.Set(reflect.MakeMap(b.m.Type()))
+		fallthrough
+	default:
+		b.m.SetMapIndex(b.key, b.item)
+	}
 }
 
 func AsValue(i interface{}) *Value {
@@ -41,6 +109,12 @@ func (v *Value) getResolvedValue() reflect.Value {
 	return v.val
 }
 
+// Path returns canonical path of the resolved value, with Go field names
+// and evaluated index arguments. It's empty for literals
+func (v *Value) Path() string {
+	return v.path
+}
+
 func (v *Value) IsKeySetter() bool {
 	return v.keySetter != nil
 }
@@ -297,115 +371,124 @@ func (v *Value) Interface() interface{} {
 	return nil
 }
 
-func (v *Value) SetNumber(nv json.Number) error {
+func (v *Value) SetNumber(nv json.Number) (err error) {
+	defer v.finish(&err, false)
+
 	resolvedValue := v.getResolvedValue()
-	switch resolvedValue.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		n, err := strconv.ParseInt(string(nv), 10, 64)
-		if err != nil || resolvedValue.OverflowInt(n) {
-			return fmt.Errorf("Can not use number %v as %s patch failure err: %v", nv, resolvedValue.Type(), err)
-		}
-		resolvedValue.SetInt(n)
-		return nil
+	if !resolvedValue.IsValid() {
+		return fmt.Errorf("Can not use number %v to patch nil value", nv)
+	}
+	n, err := v.ToRealNumber(nv, resolvedValue.Type())
+	if err != nil {
+		return err
+	}
+	if !resolvedValue.CanSet() {
+		return fmt.Errorf("Var %#v is not settable", v.val)
+	}
+	resolvedValue.Set(reflect.ValueOf(n))
+	return nil
+}
 
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-		n, err := strconv.ParseUint(string(nv), 10, 64)
-		if err != nil || resolvedValue.OverflowUint(n) {
-			return fmt.Errorf("Can not use number %v as %s patch failure err: %v", nv, resolvedValue.Type(), err)
+// ToRealNumber converts nv to a value of valueType, which can be any int,
+// uint or float kind (named types included), big.Int or big.Float.
+// Integer types also take whole numbers in exponent form such as `1e3`.
+// Numbers that don't fit valueType are reported as error
+func (v *Value) ToRealNumber(nv json.Number, valueType reflect.Type) (interface{}, error) {
+	s := string(nv)
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		// Keep exponent in a sane range, big numbers are expanded in memory
+		if exp, err := strconv.Atoi(s[i+1:]); err != nil || exp > maxNumberExp || exp < -maxNumberExp {
+			return nil, fmt.Errorf("Can not use number %v as %s, exponent is invalid or too large", nv, valueType)
 		}
-		resolvedValue.SetUint(n)
-		return nil
+	}
 
-	case reflect.Float32, reflect.Float64:
-		n, err := strconv.ParseFloat(string(nv), resolvedValue.Type().Bits())
-		if err != nil || resolvedValue.OverflowFloat(n) {
-			return fmt.Errorf("Can not use number %v as %s patch failure err: %v", resolvedValue, resolvedValue.Type(), err)
+	switch valueType {
+	case bigIntType:
+		n, err := parseInteger(s)
+		if err != nil {
+			return nil, fmt.Errorf("Can not use number %v as %s patch failure err: %v", nv, valueType, err)
 		}
-		resolvedValue.SetFloat(n)
-		return nil
-
-	default:
-		return fmt.Errorf("Can not use use value %v to patch %s type", resolvedValue, resolvedValue.Kind())
+		return *n, nil
+	case bigFloatType:
+		f, ok := new(big.Float).SetString(s)
+		if !ok {
+			return nil, fmt.Errorf("Can not use number %v as %s patch failure", nv, valueType)
+		}
+		return *f, nil
 	}
-	return nil
-}
 
-func (v *Value) ToRealNumber(nv json.Number, valueType reflect.Type) interface{} {
+	out := reflect.New(valueType).Elem()
 	switch valueType.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		n, err := strconv.ParseInt(string(nv), 10, 64)
+		n, err := parseInteger(s)
 		if err != nil {
-			return fmt.Errorf("Can not use number %v as %s patch failure err: %v", nv, valueType, err)
+			return nil, fmt.Errorf("Can not use number %v as %s patch failure err: %v", nv, valueType, err)
 		}
-		switch k := valueType.Kind(); k {
-		default:
-			panic(&reflect.ValueError{"Transform to int failure, err: %v", valueType.Kind()})
-		case reflect.Int:
-			return int(n)
-		case reflect.Int8:
-			return int8(n)
-		case reflect.Int16:
-			return int16(n)
-		case reflect.Int32:
-			return int32(n)
-		case reflect.Int64:
-			return n
+		if !n.IsInt64() || out.OverflowInt(n.Int64()) {
+			return nil, fmt.Errorf("Can not use number %v as %s, it overflows", nv, valueType)
 		}
-		return n
+		out.SetInt(n.Int64())
 
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-		n, err := strconv.ParseUint(string(nv), 10, 64)
+		n, err := parseInteger(s)
 		if err != nil {
-			return fmt.Errorf("Can not use number %v as %s patch failure err: %v", nv, valueType, err)
+			return nil, fmt.Errorf("Can not use number %v as %s patch failure err: %v", nv, valueType, err)
 		}
-		switch k := valueType.Kind(); k {
-		default:
-			panic(&reflect.ValueError{"Transform to uint failure, err: %v", valueType.Kind()})
-		case reflect.Uint:
-			return uint(n)
-		case reflect.Uint8:
-			return uint8(n)
-		case reflect.Uint16:
-			return uint16(n)
-		case reflect.Uint32:
-			return uint32(n)
-		case reflect.Uint64:
-			return n
-		case reflect.Uintptr:
-			return uintptr(n)
+		if n.Sign() < 0 || !n.IsUint64() || out.OverflowUint(n.Uint64()) {
+			return nil, fmt.Errorf("Can not use number %v as %s, it overflows", nv, valueType)
 		}
-		return n
+		out.SetUint(n.Uint64())
 
 	case reflect.Float32, reflect.Float64:
-		n, err := strconv.ParseFloat(string(nv), valueType.Bits())
+		f, err := strconv.ParseFloat(s, valueType.Bits())
 		if err != nil {
-			return fmt.Errorf("Can not use number %v as %s patch failure err: %v", valueType, valueType, err)
+			return nil, fmt.Errorf("Can not use number %v as %s patch failure err: %v", nv, valueType, err)
 		}
-		switch k := valueType.Kind(); k {
-		default:
-			panic(&reflect.ValueError{"Transform to float failure, err: %v", valueType.Kind()})
-		case reflect.Float32:
-			return int32(n)
-		case reflect.Float64:
-			return n
+		if f64, _ := strconv.ParseFloat(s, 64); valueType.Kind() == reflect.Float32 && !fitsFloat32(f64) {
+			// The same rule as for float64 values
+			return nil, fmt.Errorf("Can not use number %v as %s without losing precision", nv, valueType)
 		}
-		return n
+		out.SetFloat(f)
 
 	default:
-		return fmt.Errorf("Can not use use value %v to patch %s type", valueType, valueType.Kind())
+		return nil, fmt.Errorf("Can not use number %v to patch %s type", nv, valueType)
 	}
-	return nil
+	return out.Interface(), nil
 }
 
-func (v *Value) SetValue(rightValue interface{}) error {
+// parseInteger parses s as a whole number, exponent form is accepted as long
+// as the result has no fraction
+func parseInteger(s string) (*big.Int, error) {
+	if n, ok := new(big.Int).SetString(s, 10); ok {
+		return n, nil
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a number", s)
+	}
+	if !r.IsInt() {
+		return nil, fmt.Errorf("%s is not a whole number", s)
+	}
+	return r.Num(), nil
+}
 
-	rvType := reflect.TypeOf(rightValue)
+func (v *Value) SetValue(rightValue interface{}) error {
+	_, err := v.setValue(rightValue, false)
+	return err
+}
 
-	resolvedValue := v.getResolvedValue()
+// setValue converts rightValue and stores it in v, the stored value is
+// returned. With dryRun everything is checked but nothing is stored
+func (v *Value) setValue(rightValue interface{}, dryRun bool) (stored reflect.Value, err error) {
+	defer v.finish(&err, dryRun)
 
-	if rvType == NumberType && !v.IsKeySetter() {
-		nv := rightValue.(json.Number)
-		return v.SetNumber(nv)
+	if v.IsKeySetter() && v.keySetter.accessor != nil {
+		// The accessor converts the value itself
+		stored = reflect.ValueOf(rightValue)
+		if dryRun {
+			return stored, nil
+		}
+		return stored, v.keySetter.accessor.ELSet(&Value{val: v.keySetter.key}, AsValue(rightValue))
 	}
 
 	if v.IsKeySetter() {
@@ -413,28 +496,219 @@ func (v *Value) SetValue(rightValue interface{}) error {
 		target := setter.prev.getResolvedValue()
 		switch target.Kind() {
 		case reflect.Map:
-			if rvType == NumberType {
-				nv := rightValue.(json.Number)
-				rightValue = v.ToRealNumber(nv, target.Type().Elem())
+			cv, err := convertValue(rightValue, target.Type().Elem())
+			if err != nil {
+				return cv, err
+			}
+			if target.IsNil() && !target.CanSet() {
+				return cv, fmt.Errorf("Map %s is nil and not settable", target.Type())
 			}
-			target.SetMapIndex(setter.key, reflect.ValueOf(rightValue))
-			return nil
-		case reflect.Slice:
-			if rvType == NumberType {
-				nv := rightValue.(json.Number)
-				rightValue = v.ToRealNumber(nv, target.Type().Elem())
+			if dryRun {
+				return cv, nil
 			}
-			target.Index(int(setter.key.Int())).Set(reflect.ValueOf(rightValue))
-			return nil
+			if target.IsNil() {
+				target.Set(reflect.MakeMap(target.Type()))
+			}
+			target.SetMapIndex(setter.key, cv)
+			return cv, nil
+		case reflect.Slice, reflect.Array:
+			cv, err := convertValue(rightValue, target.Type().Elem())
+			if err != nil {
+				return cv, err
+			}
+			idx := int(setter.key.Int())
+			if idx >= target.Len() {
+				// Item is created by growing the slice
+				if target.Kind() == reflect.Array {
+					return cv, fmt.Errorf("Index out of range: %d, array %s has fixed length %d", idx, target.Type(), target.Len())
+				}
+				if !target.CanSet() {
+					return cv, fmt.Errorf("Index out of range: %d of %s", idx, target.Type())
+				}
+				if err := checkLimit("slice growth", idx+1-target.Len(), setter.maxGrowth, DefaultMaxSliceGrowth); err != nil {
+					return cv, err
+				}
+				if dryRun {
+					return cv, nil
+				}
+				growSlice(target, idx+1)
+			}
+			item := target.Index(idx)
+			if !item.CanSet() {
+				return cv, fmt.Errorf("Item %d of %s is not settable", idx, target.Type())
+			}
+			if dryRun {
+				return cv, nil
+			}
+			item.Set(cv)
+			return cv, nil
 		}
 	}
 
-	if rvType != resolvedValue.Type() {
-		return fmt.Errorf("Can not use use value %v to patch %s type", rvType, resolvedValue.Type())
+	resolvedValue := v.getResolvedValue()
+	switch {
+	case v.slot.IsValid():
+		// Replace what an interface{} field or optional wrapper holds, not the value held
+		resolvedValue = v.slot
+	case v.val.Kind() == reflect.Ptr && v.val.CanSet():
+		// Replace the pointer, which can be nil
+		resolvedValue = v.val
 	}
 	if !resolvedValue.CanSet() {
+		return resolvedValue, fmt.Errorf("Var %#v is not settable", v.val)
+	}
+	cv, err := convertValue(rightValue, resolvedValue.Type())
+	if err != nil {
+		return cv, err
+	}
+	if dryRun {
+		return cv, nil
+	}
+	resolvedValue.Set(cv)
+	return cv, nil
+}
+
+// Append appends rightValue to the slice v holds
+func (v *Value) Append(rightValue interface{}) (err error) {
+	defer v.finish(&err, false)
+
+	s := v.getResolvedValue()
+	if s.Kind() != reflect.Slice {
+		return fmt.Errorf("Can not append to %s type", s.Kind())
+	}
+	if !s.CanSet() {
 		return fmt.Errorf("Var %#v is not settable", v.val)
 	}
-	resolvedValue.Set(reflect.ValueOf(rightValue))
+	cv, err := convertValue(rightValue, s.Type().Elem())
+	if err != nil {
+		return err
+	}
+	s.Set(reflect.Append(s, cv))
+	if v.held != nil {
+		v.held.store()
+	}
 	return nil
 }
+
+// Insert inserts rightValue at the index of slice item v, the item there
+// and later ones are shifted. v can also be the item right after the last
+func (v *Value) Insert(rightValue interface{}) error {
+	_, err := v.insert(rightValue, false)
+	return err
+}
+
+// Remove removes slice item v, later items are shifted
+func (v *Value) Remove() error {
+	return v.remove(false)
+}
+
+// sliceItem returns the slice and the index of slice item v
+func (v *Value) sliceItem() (reflect.Value, int, error) {
+	if v.keySetter == nil || v.keySetter.accessor != nil {
+		return reflect.Value{}, 0, fmt.Errorf("Var %#v is not a slice item", v.val)
+	}
+	s := v.keySetter.prev.getResolvedValue()
+	if s.Kind() != reflect.Slice {
+		return reflect.Value{}, 0, fmt.Errorf("Var %#v is not a slice item", v.val)
+	}
+	if !s.CanSet() {
+		return reflect.Value{}, 0, fmt.Errorf("Slice %s is not settable", s.Type())
+	}
+	return s, int(v.keySetter.key.Int()), nil
+}
+
+func (v *Value) insert(rightValue interface{}, dryRun bool) (stored reflect.Value, err error) {
+	defer v.finish(&err, dryRun)
+
+	s, idx, err := v.sliceItem()
+	if err != nil {
+		return s, err
+	}
+	n := s.Len()
+	if idx > n {
+		return s, fmt.Errorf("Index out of range: %d, can not insert into %s of length %d", idx, s.Type(), n)
+	}
+	cv, err := convertValue(rightValue, s.Type().Elem())
+	if err != nil || dryRun {
+		return cv, err
+	}
+	growSlice(s, n+1)
+	reflect.Copy(s.Slice(idx+1, n+1), s.Slice(idx, n))
+	s.Index(idx).Set(cv)
+	return cv, nil
+}
+
+func (v *Value) remove(dryRun bool) (err error) {
+	defer v.finish(&err, dryRun)
+
+	s, idx, err := v.sliceItem()
+	if err != nil {
+		return err
+	}
+	n := s.Len()
+	if idx >= n {
+		return fmt.Errorf("Index out of range: %d, can not remove from %s of length %d", idx, s.Type(), n)
+	}
+	if dryRun {
+		return nil
+	}
+	reflect.Copy(s.Slice(idx, n-1), s.Slice(idx+1, n))
+	// Don't keep the last item alive in the backing array
+	s.Index(n - 1).Set(reflect.Zero(s.Type().Elem()))
+	s.SetLen(n - 1)
+	return nil
+}
+
+// isCreated reports whether v, or an item on the way to it, is a map key
+// added or a slice item grown for the write
+func (v *Value) isCreated() bool {
+	return v.created || (v.keySetter != nil && v.keySetter.created)
+}
+
+// isMissing reports whether v is neither a value nor a place to set one
+func (v *Value) isMissing() bool {
+	return !v.val.IsValid() && v.keySetter == nil && !v.slot.IsValid()
+}
+
+// settableType returns the type a value stored in v must have
+func (v *Value) settableType() (reflect.Type, error) {
+	if v.keySetter != nil && v.keySetter.accessor != nil && !v.val.IsValid() {
+		// Anything can be set into a missing item of an accessor
+		return reflect.TypeOf((*interface{})(nil)).Elem(), nil
+	}
+	if v.keySetter != nil && v.keySetter.accessor == nil {
+		switch target := v.keySetter.prev.getResolvedValue(); target.Kind() {
+		case reflect.Map, reflect.Slice, reflect.Array:
+			return target.Type().Elem(), nil
+		}
+	}
+	if isOptional(v.slot) {
+		// The wrapper is replaced, not the value it holds
+		return v.slot.Type(), nil
+	}
+	resolvedValue := v.getResolvedValue()
+	if !resolvedValue.IsValid() {
+		return nil, fmt.Errorf("Var %#v is nil", v.val)
+	}
+	return resolvedValue.Type(), nil
+}
+
+// currentOrZero returns the type of v and its current value, which is the
+// zero value when v is a missing map key or slice item. The type is an
+// interface type only for a missing or nil interface item
+func (v *Value) currentOrZero() (reflect.Type, reflect.Value, error) {
+	typ, err := v.settableType()
+	if err != nil {
+		return nil, reflect.Value{}, err
+	}
+	if adapter, ok := optionalAdapter(typ); ok {
+		// Ops work on the value an optional wrapper holds
+		typ = adapter.ValueType(typ)
+	}
+	current := v.getResolvedValue()
+	if (v.keySetter != nil && v.keySetter.created) || !current.IsValid() {
+		return typ, reflect.Zero(typ), nil
+	}
+	// The type of the value held tells more than an interface{} item type
+	return current.Type(), current, nil
+}